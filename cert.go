@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/tls"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// min interval between checks of cert files
+const certCheckInterval = 10 * time.Second
+
+// tls config of the server, certificates are issued by acme if domains are set,
+// otherwise loaded from cert files and reloaded when they change.
+// challenge is the started http-01 listener, nil if not configured.
+func (c *config) tlsConfig() (cfg *tls.Config, challenge *http.Server, err error) {
+	if len(c.Tls.Acme.Domains) == 0 {
+		r, err := newCertReloader(c.Tls.Cert, c.Tls.Key)
+		if err != nil {
+			return nil, nil, err
+		}
+		cfg = &tls.Config{GetCertificate: r.GetCertificate}
+		return cfg, nil, nil
+	}
+
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(c.Tls.Acme.Domains...),
+		Cache:      autocert.DirCache(c.Tls.Acme.CacheDir),
+		Email:      c.Tls.Acme.Email,
+	}
+	if c.Tls.Acme.Directory != "" {
+		m.Client = &acme.Client{DirectoryURL: c.Tls.Acme.Directory}
+	}
+
+	// http-01 challenge, other requests are redirected to https
+	if c.Tls.Acme.Http != "" {
+		challenge = &http.Server{Addr: c.Tls.Acme.Http, Handler: m.HTTPHandler(nil)}
+		go func() {
+			err := challenge.ListenAndServe()
+			if err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	// tls-alpn-01 challenge is answered in handshake
+	cfg = m.TLSConfig()
+	return
+}
+
+// certReloader reloads cert and key files when their modification time changes.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	cert     *tls.Certificate
+	modTime  time.Time
+	checked  time.Time
+	lock     sync.Mutex
+}
+
+func newCertReloader(certFile, keyFile string) (r *certReloader, err error) {
+	r = &certReloader{certFile: certFile, keyFile: keyFile}
+	err = r.reload()
+	return
+}
+
+// latest modification time of cert and key files
+func (r *certReloader) fileTime() (t time.Time, err error) {
+	for _, name := range []string{r.certFile, r.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return t, err
+		}
+		if info.ModTime().After(t) {
+			t = info.ModTime()
+		}
+	}
+	return
+}
+
+func (r *certReloader) reload() (err error) {
+	modTime, err := r.fileTime()
+	if err != nil {
+		return
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return
+	}
+	r.cert = &cert
+	r.modTime = modTime
+	return
+}
+
+// keep the old certificate if new files are missing or invalid, e.g. in the middle of renewal.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	now := time.Now()
+	if now.Sub(r.checked) >= certCheckInterval {
+		r.checked = now
+		modTime, err := r.fileTime()
+		if err == nil && !modTime.Equal(r.modTime) {
+			err = r.reload()
+			if err == nil {
+				log.Printf("certificate reloaded: %s\n", r.certFile)
+			}
+		}
+		if err != nil {
+			log.Println(err.Error())
+		}
+	}
+	return r.cert, nil
+}
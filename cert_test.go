@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// write a self-signed certificate with given common name
+func writeTestCert(t *testing.T, certFile, keyFile, name string, modTime time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	os.Chtimes(certFile, modTime, modTime)
+	os.Chtimes(keyFile, modTime, modTime)
+}
+
+func certName(t *testing.T, r *certReloader) string {
+	r.checked = time.Time{}
+	cert, err := r.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wxproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "wxproxy.crt"), filepath.Join(dir, "wxproxy.key")
+
+	if _, err := newCertReloader(certFile, keyFile); err == nil {
+		t.Fatal("missing cert files are accepted")
+	}
+
+	now := time.Now()
+	writeTestCert(t, certFile, keyFile, "old", now.Add(-time.Hour))
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := certName(t, r); name != "old" {
+		t.Fatal(name)
+	}
+
+	// renewed
+	writeTestCert(t, certFile, keyFile, "new", now)
+	if name := certName(t, r); name != "new" {
+		t.Fatal(name)
+	}
+
+	// broken files keep current certificate
+	ioutil.WriteFile(keyFile, []byte("broken"), 0600)
+	if name := certName(t, r); name != "new" {
+		t.Fatal(name)
+	}
+}
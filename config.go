@@ -0,0 +1,252 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"wechat-proxy/enterprise"
+	"wechat-proxy/wechat"
+	"wechat-proxy/wrap"
+
+	"gopkg.in/yaml.v2"
+)
+
+// settings of wxproxy, loaded from defaults, config file, env and flags in order.
+type config struct {
+	Listen string `yaml:"listen"`
+	Tls    struct {
+		Enable bool   `yaml:"enable"`
+		Cert   string `yaml:"cert"`
+		Key    string `yaml:"key"`
+		Acme   struct {
+			Domains   []string `yaml:"domains"` // certificates are issued by acme if set
+			Email     string   `yaml:"email"`
+			CacheDir  string   `yaml:"cache_dir"` // issued certificates and account key
+			Http      string   `yaml:"http"`      // listen address for http-01 challenge, empty to disable
+			Directory string   `yaml:"directory"` // acme directory url, default is letsencrypt
+		} `yaml:"acme"`
+	} `yaml:"tls"`
+	Db       string `yaml:"db"`
+	Admin    string `yaml:"admin"`
+	LogLevel string `yaml:"log_level"` // debug, info, off
+
+	// anonymous /register of apps without owner when admin token is not set, as old versions did
+	OpenRegister bool `yaml:"open_register"`
+
+	Cache struct {
+		Token int `yaml:"token"` // access_token and tickets
+		Auth  int `yaml:"auth"`  // pending oauth requests
+		Pay   int `yaml:"pay"`   // unpaid orders
+		Media int `yaml:"media"` // uploaded media ids
+		Store int `yaml:"store"` // history records of each kind in memory storage
+	} `yaml:"cache"`
+	Timeout struct {
+		Message  string `yaml:"message"`
+		Webhook  string `yaml:"webhook"`
+		Shutdown string `yaml:"shutdown"` // drain requests and background tasks before exit
+	} `yaml:"timeout"`
+	BaseUrl struct {
+		Api   string `yaml:"api"`
+		Open  string `yaml:"open"`
+		Mp    string `yaml:"mp"`
+		Pay   string `yaml:"pay"`
+		Qyapi string `yaml:"qyapi"`
+	} `yaml:"base_url"`
+
+	// apps registered at startup
+	Apps []wrap.AppConfig `yaml:"apps"`
+
+	shutdownTimeout time.Duration
+}
+
+func defaultConfig() *config {
+	c := new(config)
+	c.Listen = ":8080"
+	c.Tls.Cert = "wxproxy.crt"
+	c.Tls.Key = "wxproxy.key"
+	c.Tls.Acme.CacheDir = "wxproxy-certs"
+	c.Db = "memory://wxproxy.json"
+	c.LogLevel = wechat.LogLevel
+	c.Cache.Token = wechat.TokenCacheLimit
+	c.Cache.Auth = wechat.AuthRequestLimit
+	c.Cache.Pay = wechat.PayCacheLimit
+	c.Cache.Media = wechat.MediaCacheLimit
+	c.Cache.Store = wrap.StoreCacheLimit
+	c.Timeout.Message = wechat.MessageRequestTimeout.String()
+	c.Timeout.Webhook = wrap.WebhookTimeout.String()
+	c.Timeout.Shutdown = "30s"
+	c.BaseUrl.Api = wechat.ApiBaseUrl
+	c.BaseUrl.Open = wechat.OpenBaseUrl
+	c.BaseUrl.Mp = wechat.MpBaseUrl
+	c.BaseUrl.Pay = wechat.PayBaseUrl
+	c.BaseUrl.Qyapi = enterprise.BaseUrl
+	return c
+}
+
+// env names of settings, e.g. WXPROXY_CACHE_TOKEN=200, lists are separated by comma
+func (c *config) envs() map[string]interface{} {
+	return map[string]interface{}{
+		"WXPROXY_LISTEN":           &c.Listen,
+		"WXPROXY_TLS":              &c.Tls.Enable,
+		"WXPROXY_TLS_CERT":         &c.Tls.Cert,
+		"WXPROXY_TLS_KEY":          &c.Tls.Key,
+		"WXPROXY_ACME_DOMAINS":     &c.Tls.Acme.Domains,
+		"WXPROXY_ACME_EMAIL":       &c.Tls.Acme.Email,
+		"WXPROXY_ACME_CACHE_DIR":   &c.Tls.Acme.CacheDir,
+		"WXPROXY_ACME_HTTP":        &c.Tls.Acme.Http,
+		"WXPROXY_ACME_DIRECTORY":   &c.Tls.Acme.Directory,
+		"WXPROXY_DB":               &c.Db,
+		"WXPROXY_ADMIN_TOKEN":      &c.Admin,
+		"WXPROXY_OPEN_REGISTER":    &c.OpenRegister,
+		"WXPROXY_LOG_LEVEL":        &c.LogLevel,
+		"WXPROXY_CACHE_TOKEN":      &c.Cache.Token,
+		"WXPROXY_CACHE_AUTH":       &c.Cache.Auth,
+		"WXPROXY_CACHE_PAY":        &c.Cache.Pay,
+		"WXPROXY_CACHE_MEDIA":      &c.Cache.Media,
+		"WXPROXY_CACHE_STORE":      &c.Cache.Store,
+		"WXPROXY_TIMEOUT_MESSAGE":  &c.Timeout.Message,
+		"WXPROXY_TIMEOUT_WEBHOOK":  &c.Timeout.Webhook,
+		"WXPROXY_TIMEOUT_SHUTDOWN": &c.Timeout.Shutdown,
+		"WXPROXY_BASE_URL_API":     &c.BaseUrl.Api,
+		"WXPROXY_BASE_URL_OPEN":    &c.BaseUrl.Open,
+		"WXPROXY_BASE_URL_MP":      &c.BaseUrl.Mp,
+		"WXPROXY_BASE_URL_PAY":     &c.BaseUrl.Pay,
+		"WXPROXY_BASE_URL_QYAPI":   &c.BaseUrl.Qyapi,
+	}
+}
+
+func (c *config) loadFile(path string) (err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return
+	}
+	err = yaml.UnmarshalStrict(data, c)
+	if err != nil {
+		err = fmt.Errorf("%s: %s", path, err.Error())
+	}
+	return
+}
+
+func (c *config) loadEnv(getenv func(string) string) (err error) {
+	for name, p := range c.envs() {
+		v := getenv(name)
+		if v == "" {
+			continue
+		}
+		switch p := p.(type) {
+		case *string:
+			*p = v
+		case *int:
+			*p, err = strconv.Atoi(v)
+		case *bool:
+			*p, err = strconv.ParseBool(v)
+		case *[]string:
+			*p = strings.Split(v, ",")
+		}
+		if err != nil {
+			err = fmt.Errorf("%s: %s", name, err.Error())
+			return
+		}
+	}
+	return
+}
+
+// set package settings, must be called before servers are created.
+func (c *config) apply() (err error) {
+	message, err := time.ParseDuration(c.Timeout.Message)
+	if err != nil {
+		return
+	}
+	webhook, err := time.ParseDuration(c.Timeout.Webhook)
+	if err != nil {
+		return
+	}
+	c.shutdownTimeout, err = time.ParseDuration(c.Timeout.Shutdown)
+	if err != nil {
+		return
+	}
+	switch c.LogLevel {
+	case "debug", "info":
+	case "off":
+		log.SetOutput(ioutil.Discard)
+	default:
+		err = fmt.Errorf("unknown log level: %s", c.LogLevel)
+		return
+	}
+
+	wechat.LogLevel = c.LogLevel
+	wechat.TokenCacheLimit = c.Cache.Token
+	wechat.AuthRequestLimit = c.Cache.Auth
+	wechat.PayCacheLimit = c.Cache.Pay
+	wechat.MediaCacheLimit = c.Cache.Media
+	wrap.StoreCacheLimit = c.Cache.Store
+	wechat.MessageRequestTimeout = message
+	wrap.WebhookTimeout = webhook
+	wechat.ApiBaseUrl = c.BaseUrl.Api
+	wechat.OpenBaseUrl = c.BaseUrl.Open
+	wechat.MpBaseUrl = c.BaseUrl.Mp
+	wechat.PayBaseUrl = c.BaseUrl.Pay
+	enterprise.BaseUrl = c.BaseUrl.Qyapi
+	return
+}
+
+// load settings, flags override env, env overrides config file.
+func loadConfig(args []string) (c *config, rekey bool, err error) {
+	var path, host string
+	var port uint
+	tls, openRegister := false, false
+	admin, dsn := "", ""
+
+	fs := flag.NewFlagSet(args[0], flag.ExitOnError)
+	fs.StringVar(&path, "config", os.Getenv("WXPROXY_CONFIG"), "Config file (yaml).")
+	fs.StringVar(&host, "host", "", "Listening host.")
+	fs.UintVar(&port, "port", 8080, "Listening port.")
+	fs.UintVar(&port, "p", 8080, "Listening port.")
+	fs.BoolVar(&tls, "tls", false, "Https scheme.")
+	fs.StringVar(&admin, "admin", "", "Admin token for /register and /admin.")
+	fs.BoolVar(&openRegister, "open-register", false, "Allow /register without credential when admin token is not set.")
+	fs.BoolVar(&rekey, "rekey", false, "Encrypt secrets with current master key and exit.")
+	fs.StringVar(&dsn, "db", "", "Storage dsn: memory, memory://wxproxy.json, sqlite://wxproxy.db, postgres://..., mysql://...")
+	fs.Parse(args[1:])
+
+	c = defaultConfig()
+	if path != "" {
+		err = c.loadFile(path)
+		if err != nil {
+			return
+		}
+	}
+	err = c.loadEnv(os.Getenv)
+	if err != nil {
+		return
+	}
+
+	listenHost, listenPort, err := net.SplitHostPort(c.Listen)
+	if err != nil {
+		return
+	}
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "host":
+			listenHost = host
+		case "port", "p":
+			listenPort = strconv.Itoa(int(port))
+		case "tls":
+			c.Tls.Enable = tls
+		case "admin":
+			c.Admin = admin
+		case "open-register":
+			c.OpenRegister = openRegister
+		case "db":
+			c.Db = dsn
+		}
+	})
+	c.Listen = net.JoinHostPort(listenHost, listenPort)
+	return
+}
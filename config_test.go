@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wxproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "wxproxy.yml")
+	data := `
+listen: 127.0.0.1:9000
+tls:
+  enable: true
+  cert: /etc/wxproxy/cert.pem
+db: sqlite://wxproxy.db
+log_level: info
+cache:
+  token: 200
+timeout:
+  message: 3s
+apps:
+  - key: test
+    appid: wx1
+    secret: s1
+    calls: [/api, /msg]
+`
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv("WXPROXY_CACHE_TOKEN", "300")
+	os.Setenv("WXPROXY_DB", "memory")
+	defer os.Unsetenv("WXPROXY_CACHE_TOKEN")
+	defer os.Unsetenv("WXPROXY_DB")
+
+	c, rekey, err := loadConfig([]string{"wxproxy", "-config", path, "-p", "9001", "-db", "memory://test.json", "-open-register"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	switch {
+	case rekey:
+		t.Fatal("rekey")
+	case c.Listen != "127.0.0.1:9001":
+		t.Fatal(c.Listen)
+	case !c.Tls.Enable || c.Tls.Cert != "/etc/wxproxy/cert.pem" || c.Tls.Key != "wxproxy.key":
+		t.Fatal(c.Tls)
+	case c.Db != "memory://test.json":
+		t.Fatal(c.Db)
+	case c.Cache.Token != 300 || c.Cache.Pay != 1000:
+		t.Fatal(c.Cache)
+	case c.Timeout.Message != "3s" || c.LogLevel != "info":
+		t.Fatal(c.Timeout, c.LogLevel)
+	case !c.OpenRegister:
+		t.Fatal("open register")
+	case len(c.Apps) != 1 || c.Apps[0].AppId != "wx1" || len(c.Apps[0].Calls) != 2:
+		t.Fatal(c.Apps)
+	}
+}
+
+func TestConfigInvalid(t *testing.T) {
+	c := defaultConfig()
+	err := c.loadEnv(func(name string) string {
+		if name == "WXPROXY_CACHE_PAY" {
+			return "many"
+		}
+		return ""
+	})
+	if err == nil {
+		t.Fatal("invalid int is accepted")
+	}
+
+	c = defaultConfig()
+	c.Timeout.Webhook = "10"
+	if err := c.apply(); err == nil {
+		t.Fatal("invalid duration is accepted")
+	}
+	c = defaultConfig()
+	c.LogLevel = "verbose"
+	if err := c.apply(); err == nil {
+		t.Fatal("invalid log level is accepted")
+	}
+}
@@ -19,6 +19,9 @@ const (
 	tokenCacheLimit = 100
 )
 
+// upstream base url, may be changed to a gateway or mock server
+var BaseUrl = "https://qyapi.weixin.qq.com"
+
 // doc: https://work.weixin.qq.com/api/doc#10013
 type WechatQyServer struct {
 	tokenMap *wx.CacheMap
@@ -27,6 +30,7 @@ type WechatQyServer struct {
 func NewQyServer() *WechatQyServer {
 	srv := new(WechatQyServer)
 	srv.tokenMap = wx.NewCacheMap(tokenCacheDuration, tokenCacheLimit)
+	wx.TrackCache("qyapi_token", srv.tokenMap)
 	return srv
 }
 
@@ -68,7 +72,7 @@ func (srv *WechatQyServer) hashKey(appid, secret string) string {
 
 // https://qyapi.weixin.qq.com/cgi-bin/gettoken?corpid=CORPID&corpsecret=SECRET
 func (srv *WechatQyServer) accessTokenUrl(appid, secret string) string {
-	baseUrl := "https://qyapi.weixin.qq.com/cgi-bin/gettoken"
+	baseUrl := BaseUrl + "/cgi-bin/gettoken"
 	_url := fmt.Sprintf("%s?corpid=%s&corpsecret=%s", baseUrl, appid, secret)
 	return _url
 }
@@ -6,17 +6,16 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"sort"
 	"strings"
 	"time"
 )
 
-const (
-	// access_token stay time in memory
-	tokenCacheDuration = 3600 * time.Second
+// access_token stay time in memory
+const tokenCacheDuration = 3600 * time.Second
 
-	// access_token max count in memory
-	tokenCacheLimit = 100
-)
+// access_token max count in memory, also for jsapi and card tickets
+var TokenCacheLimit = 100
 
 type WxAccessToken struct {
 	WxError
@@ -24,6 +23,22 @@ type WxAccessToken struct {
 	ExpiresIn   uint64 `json:"expires_in"`
 }
 
+type cachedToken struct {
+	appid      string
+	body       []byte
+	expiresIn  uint64
+	createTime time.Time
+}
+
+// TokenStatus describes a cached access_token without its value.
+type TokenStatus struct {
+	AppId      string
+	CreateTime int64  // 获取时间
+	Age        int64  // 已缓存秒数
+	ExpiresIn  uint64 // 有效期(秒)
+	Expired    bool
+}
+
 // doc: https://mp.weixin.qq.com/wiki?t=resource/res_main&id=mp1421140183
 type WechatApiServer struct {
 	tokenMap *CacheMap
@@ -31,7 +46,8 @@ type WechatApiServer struct {
 
 func NewApiServer() *WechatApiServer {
 	srv := new(WechatApiServer)
-	srv.tokenMap = NewCacheMap(tokenCacheDuration, tokenCacheLimit)
+	srv.tokenMap = NewCacheMap(tokenCacheDuration, TokenCacheLimit)
+	TrackCache("token", srv.tokenMap)
 	return srv
 }
 
@@ -41,11 +57,14 @@ func (srv *WechatApiServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	// find token
 	key := srv.hashKey(appid, secret)
+	result := "miss"
 	if strings.HasSuffix(r.URL.Path, "/new") {
 		srv.tokenMap.Remove(key)
+		result = "refresh"
 	}
 	if value, ok := srv.tokenMap.Get(key); ok {
-		w.Write(value.([]byte))
+		tokenCacheTotal.WithLabelValues(appid, "hit").Inc()
+		w.Write(value.(cachedToken).body)
 		return
 	}
 
@@ -53,20 +72,45 @@ func (srv *WechatApiServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	_url := srv.accessTokenUrl(appid, secret)
 	body, err := srv.httpGetJson(_url, token)
 	if err != nil {
+		tokenCacheTotal.WithLabelValues(metricOther, result).Inc()
 		w.Write([]byte(NewError(err).String()))
 		return
 	}
 	if !token.Success() {
+		tokenCacheTotal.WithLabelValues(metricOther, result).Inc()
 		w.Write([]byte(token.WxError.String()))
 		return
 	}
 
+	// appid is labeled after it's validated by wechat
+	tokenCacheTotal.WithLabelValues(appid, result).Inc()
 	w.Write(body)
-	srv.tokenMap.Set(key, body)
+	srv.tokenMap.Set(key, cachedToken{appid, body, token.ExpiresIn, time.Now()})
 	go srv.tokenMap.Shrink()
 	return
 }
 
+// Tokens lists cached access_token status, sorted by appid.
+func (srv *WechatApiServer) Tokens() (tokens []TokenStatus) {
+	now := time.Now()
+	srv.tokenMap.Range(func(key string, value interface{}) bool {
+		t := value.(cachedToken)
+		age := int64(now.Sub(t.createTime) / time.Second)
+		tokens = append(tokens, TokenStatus{
+			AppId:      t.appid,
+			CreateTime: t.createTime.Unix(),
+			Age:        age,
+			ExpiresIn:  t.expiresIn,
+			Expired:    age >= int64(t.expiresIn),
+		})
+		return true
+	})
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].AppId < tokens[j].AppId
+	})
+	return
+}
+
 func (srv *WechatApiServer) hashKey(appid, secret string) string {
 	hashBytes := md5.Sum([]byte(appid + ":" + secret))
 	return string(hashBytes[:])
@@ -74,7 +118,7 @@ func (srv *WechatApiServer) hashKey(appid, secret string) string {
 
 // url: https://api.weixin.qq.com/cgi-bin/token?grant_type=client_credential&appid=APPID&secret=SECRET
 func (srv *WechatApiServer) accessTokenUrl(appid, secret string) string {
-	baseUrl := "https://api.weixin.qq.com/cgi-bin/token?grant_type=client_credential"
+	baseUrl := ApiBaseUrl + "/cgi-bin/token?grant_type=client_credential"
 	_url := fmt.Sprintf("%s&appid=%s&secret=%s", baseUrl, appid, secret)
 	return _url
 }
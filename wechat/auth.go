@@ -13,27 +13,32 @@ import (
 	"time"
 )
 
-const (
-	authRequestDuration = 5 * time.Minute
-	authRequestLimit    = 1000
-)
+const authRequestDuration = 5 * time.Minute
+
+// pending auth requests max count in memory
+var AuthRequestLimit = 1000
 
 // https://mp.weixin.qq.com/wiki?t=resource/res_main&id=mp1421140842
 type WechatAuthServer struct {
 	WechatClient
 	requestMap *CacheMap
+
+	// binds the auth flow started by r to a func giving openids of the same unionid
+	// in other apps, keyed by appid. nil means no links.
+	LinkOpenIds func(r *http.Request, appid string) func(unionid string) map[string]string
 }
 
 func NewAuthServer() *WechatAuthServer {
 	srv := new(WechatAuthServer)
-	srv.requestMap = NewCacheMap(authRequestDuration, authRequestLimit)
+	srv.requestMap = NewCacheMap(authRequestDuration, AuthRequestLimit)
+	TrackCache("auth", srv.requestMap)
 	return srv
 }
 
 // /auth?appid=...&secret=...&call=...&lang=
 // /auth/info?appid=...&secret=...&call=...&lang=
 func (srv *WechatAuthServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	log.Println(r.RequestURI)
+	Debugln(r.RequestURI)
 
 	r.ParseForm()
 	f := r.Form
@@ -64,6 +69,11 @@ func (srv *WechatAuthServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	info := &wxUserInfo{}
 	defer srv.postInfo(w, &p, info)
+	defer func() {
+		if info.Success() {
+			authFlowTotal.WithLabelValues(p.AppId, "completed").Inc()
+		}
+	}()
 
 	// request auth token
 	t, wxErr := srv.authToken(r, &p, code)
@@ -71,11 +81,13 @@ func (srv *WechatAuthServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		info.WxError = *wxErr
 		return
 	}
+	// appid is validated by wechat when code is exchanged
+	authFlowTotal.WithLabelValues(p.AppId, "started").Inc()
 	info.OpenId = t.OpenId
 
 	// request user info
 	if t.Scope == "snsapi_userinfo" {
-		info_url := "https://api.weixin.qq.com/sns/userinfo?access_token=%s&openid=%s&lang=%s"
+		info_url := ApiBaseUrl + "/sns/userinfo?access_token=%s&openid=%s&lang=%s"
 		_url := fmt.Sprintf(info_url, t.AuthToken, t.OpenId, p.Lang)
 		_, err := HttpGetJson(_url, &info)
 		if err != nil {
@@ -90,7 +102,7 @@ func (srv *WechatAuthServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		info_url := "https://api.weixin.qq.com/cgi-bin/user/info?access_token=%s&openid=%s&lang=%s"
+		info_url := ApiBaseUrl + "/cgi-bin/user/info?access_token=%s&openid=%s&lang=%s"
 		_url := fmt.Sprintf(info_url, access_token, t.OpenId, p.Lang)
 		_, err := HttpGetJson(_url, &info)
 		if err != nil {
@@ -110,6 +122,9 @@ func (srv *WechatAuthServer) authUrl(r *http.Request) string {
 		State:  f.Get("state"),
 		Lang:   f.Get("lang"),
 	}
+	if srv.LinkOpenIds != nil {
+		p.links = srv.LinkOpenIds(r, p.AppId)
+	}
 
 	scope := "snsapi_base"
 	if strings.HasSuffix(r.URL.Path, "/info") {
@@ -125,7 +140,7 @@ func (srv *WechatAuthServer) authUrl(r *http.Request) string {
 	// generate auth url
 	// doc: https://mp.weixin.qq.com/wiki?t=resource/res_main&id=mp1421140839
 	redirect_uri := fmt.Sprintf("%s%s?key=%s", srv.HostUrl(r), r.URL.Path, key)
-	base_url := "https://open.weixin.qq.com/connect/oauth2/authorize"
+	base_url := OpenBaseUrl + "/connect/oauth2/authorize"
 	auth_url := fmt.Sprintf("%s?appid=%s&redirect_uri=%s&response_type=code&scope=%s&state=%s#wechat_redirect",
 		base_url, p.AppId, url.QueryEscape(redirect_uri), scope, p.State)
 
@@ -134,7 +149,7 @@ func (srv *WechatAuthServer) authUrl(r *http.Request) string {
 
 func (srv *WechatAuthServer) authToken(r *http.Request, p *authParam, code string) (t *wxAuthToken, wxErr *WxError) {
 
-	base_url := "https://api.weixin.qq.com/sns/oauth2/access_token"
+	base_url := ApiBaseUrl + "/sns/oauth2/access_token"
 	token_url := fmt.Sprintf("%s?appid=%s&secret=%s&code=%s&grant_type=authorization_code",
 		base_url, p.AppId, p.Secret, code)
 
@@ -159,6 +174,9 @@ func (srv *WechatAuthServer) postInfo(w http.ResponseWriter, p *authParam, info
 		State:      p.State,
 		Sign:       "",
 	}
+	if p.links != nil && info.UnionId != "" {
+		f.Links = p.links(info.UnionId)
+	}
 	f.Sign = srv.signForm(f, p.Secret)
 
 	bs, err := json.Marshal(f)
@@ -184,11 +202,20 @@ func (*WechatAuthServer) signForm(f *authForm, key string) string {
 	t := reflect.TypeOf(*f)
 	v := reflect.ValueOf(*f)
 	for i := 0; i < t.NumField(); i++ {
-		if v.Field(i).Kind() != reflect.String {
+		name := strings.ToLower(t.Field(i).Name)
+		var value string
+		switch v.Field(i).Kind() {
+		case reflect.String:
+			value = v.Field(i).String()
+		case reflect.Map:
+			// map keys are sorted by json
+			if v.Field(i).Len() > 0 {
+				bs, _ := json.Marshal(v.Field(i).Interface())
+				value = string(bs)
+			}
+		default:
 			continue
 		}
-		name := strings.ToLower(t.Field(i).Name)
-		value := v.Field(i).String()
 		if value == "" {
 			continue
 		}
@@ -209,13 +236,16 @@ type authParam struct {
 	Call   string
 	State  string
 	Lang   string
+
+	links func(unionid string) map[string]string
 }
 
 type authForm struct {
 	wxUserInfo
-	AppId string `json:"appid"`
-	State string `json:"state"`
-	Sign  string `json:"sign"`
+	AppId string            `json:"appid"`
+	State string            `json:"state"`
+	Sign  string            `json:"sign"`
+	Links map[string]string `json:"links,omitempty"` // 同一unionid在其他公众号的openid
 }
 
 type wxAuthToken struct {
@@ -0,0 +1,33 @@
+package wechat
+
+import (
+	"sync"
+	"time"
+)
+
+// background tasks to finish before exit, e.g. event handlers and notify deliveries
+var background sync.WaitGroup
+
+// Go runs f in a goroutine tracked by Wait.
+func Go(f func()) {
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		f()
+	}()
+}
+
+// Wait waits for background tasks, returns false if they are not finished in timeout.
+func Wait(timeout time.Duration) bool {
+	done := make(chan bool)
+	go func() {
+		background.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
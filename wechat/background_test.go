@@ -0,0 +1,18 @@
+package wechat
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackgroundWait(t *testing.T) {
+	release := make(chan bool)
+	Go(func() { <-release })
+	if Wait(10 * time.Millisecond) {
+		t.Fatal("unfinished task is not waited")
+	}
+	close(release)
+	if !Wait(time.Second) {
+		t.Fatal("finished task is still waited")
+	}
+}
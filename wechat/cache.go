@@ -2,13 +2,14 @@ package wechat
 
 import (
 	"errors"
+	"sort"
 	"sync"
 	"time"
 )
 
 type cacheItem struct {
 	value  interface{}
-	expire int64
+	expire int64 // unix nano, items are evicted in this order
 }
 
 type CacheMap struct {
@@ -29,7 +30,7 @@ func NewCacheMap(duration time.Duration, limit int) *CacheMap {
 }
 
 func (tm *CacheMap) Set(key string, value interface{}) {
-	expire := time.Now().Add(tm.config.duration).Unix()
+	expire := time.Now().Add(tm.config.duration).UnixNano()
 	tm.lock.Lock()
 	defer tm.lock.Unlock()
 	tm.m[key] = cacheItem{value: value, expire: expire}
@@ -40,7 +41,7 @@ func (tm *CacheMap) Get(key string) (value interface{}, success bool) {
 	defer tm.lock.RUnlock()
 	if token, ok := tm.m[key]; ok {
 		value = token.value
-		success = (time.Now().Unix() < token.expire)
+		success = (time.Now().UnixNano() < token.expire)
 	}
 	return
 }
@@ -51,18 +52,57 @@ func (tm *CacheMap) Remove(key string) {
 	delete(tm.m, key)
 }
 
+// Range calls f for each unexpired item, stop when f returns false.
+func (tm *CacheMap) Range(f func(key string, value interface{}) bool) {
+	now := time.Now().UnixNano()
+	items := make(map[string]interface{})
+	tm.lock.RLock()
+	for k, v := range tm.m {
+		if now < v.expire {
+			items[k] = v.value
+		}
+	}
+	tm.lock.RUnlock()
+
+	for k, v := range items {
+		if !f(k, v) {
+			return
+		}
+	}
+}
+
+// Len returns item count, including expired items not yet shrunk.
+func (tm *CacheMap) Len() int {
+	tm.lock.RLock()
+	defer tm.lock.RUnlock()
+	return len(tm.m)
+}
+
+// Shrink removes expired items when the limit is reached,
+// then the oldest items (earliest to expire) if there are still more than the limit.
 func (tm *CacheMap) Shrink() {
 	tm.lock.Lock()
 	defer tm.lock.Unlock()
 	if len(tm.m) < tm.config.limit {
 		return
 	}
-	now := time.Now().Unix()
+	now := time.Now().UnixNano()
 	for k := range tm.m {
 		if tm.m[k].expire < now {
 			delete(tm.m, k)
 		}
 	}
+	if len(tm.m) <= tm.config.limit {
+		return
+	}
+	keys := make([]string, 0, len(tm.m))
+	for k := range tm.m {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return tm.m[keys[i]].expire < tm.m[keys[j]].expire })
+	for _, k := range keys[:len(keys)-tm.config.limit] {
+		delete(tm.m, k)
+	}
 }
 
 var ErrCacheTimeout = errors.New("cache timeout")
@@ -46,3 +46,28 @@ func TestCacheMap(t *testing.T) {
 		t.Fatal()
 	}
 }
+
+func TestCacheMapLen(t *testing.T) {
+	cache := NewCacheMap(time.Second, 10)
+	cache.Set("a", 1)
+	cache.Set("b", 2)
+	cache.Remove("a")
+	if n := cache.Len(); n != 1 {
+		t.Fatal(n)
+	}
+}
+
+func TestCacheMapShrinkOldest(t *testing.T) {
+	cache := NewCacheMap(time.Hour, 2)
+	cache.Set("a", 1)
+	cache.m["a"] = cacheItem{value: 1, expire: time.Now().Add(time.Minute).UnixNano()}
+	cache.Set("b", 2)
+	cache.Set("c", 3)
+	cache.Shrink()
+	if _, ok := cache.Get("a"); ok || cache.Len() != 2 {
+		t.Fatal(cache.Len())
+	}
+	if _, ok := cache.Get("c"); !ok {
+		t.Fatal("newest item removed")
+	}
+}
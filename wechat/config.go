@@ -0,0 +1,27 @@
+package wechat
+
+import "log"
+
+// upstream base urls, may be changed to a gateway or mock server
+var (
+	ApiBaseUrl  = "https://api.weixin.qq.com"
+	OpenBaseUrl = "https://open.weixin.qq.com"
+	MpBaseUrl   = "https://mp.weixin.qq.com"
+	PayBaseUrl  = "https://api.mch.weixin.qq.com"
+)
+
+// log level: debug (default), info, off.
+// requests, message bodies and upstream urls are only logged in debug level.
+var LogLevel = "debug"
+
+func Debugln(v ...interface{}) {
+	if LogLevel == "debug" {
+		log.Println(v...)
+	}
+}
+
+func Debugf(format string, v ...interface{}) {
+	if LogLevel == "debug" {
+		log.Printf(format, v...)
+	}
+}
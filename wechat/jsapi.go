@@ -12,7 +12,8 @@ type WechatJsTicketServer struct {
 
 func NewJsTicketServer() *WechatJsTicketServer {
 	srv := new(WechatJsTicketServer)
-	srv.ticketMap = NewCacheMap(tokenCacheDuration, tokenCacheLimit)
+	srv.ticketMap = NewCacheMap(tokenCacheDuration, TokenCacheLimit)
+	TrackCache("jsapi", srv.ticketMap)
 	return srv
 }
 
@@ -36,7 +37,7 @@ func (srv *WechatJsTicketServer) ServeHTTP(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	jsapi_base_url := "https://api.weixin.qq.com/cgi-bin/ticket/getticket"
+	jsapi_base_url := ApiBaseUrl + "/cgi-bin/ticket/getticket"
 	_url := fmt.Sprintf("%s?access_token=%s&type=jsapi", jsapi_base_url, access_token)
 	var t wxJsTicket
 	body, err := HttpGetJson(_url, &t)
@@ -19,7 +19,8 @@ type WechatCardServer struct {
 
 func NewCardServer() *WechatCardServer {
 	srv := new(WechatCardServer)
-	srv.ticketMap = NewCacheMap(tokenCacheDuration, tokenCacheLimit)
+	srv.ticketMap = NewCacheMap(tokenCacheDuration, TokenCacheLimit)
+	TrackCache("card", srv.ticketMap)
 	return srv
 }
 
@@ -43,7 +44,7 @@ func (srv *WechatCardServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	card_base_url := "https://api.weixin.qq.com/cgi-bin/ticket/getticket"
+	card_base_url := ApiBaseUrl + "/cgi-bin/ticket/getticket"
 	_url := fmt.Sprintf("%s?access_token=%s&type=wx_card", card_base_url, access_token)
 	var t wxJsTicket
 	body, err := HttpGetJson(_url, &t)
@@ -0,0 +1,273 @@
+package wechat
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// temporary media is kept by wechat for 3 days
+	mediaCacheDuration = 71 * time.Hour
+
+	// permanent material never expires, keep it as long as the proxy lives
+	materialCacheDuration = 365 * 24 * time.Hour
+
+	// max size of uploaded media file
+	mediaMaxSize = 10 << 20
+
+	// max size of request body, media file and other form fields
+	mediaMaxBody = mediaMaxSize + 1<<20
+)
+
+var errMediaAddress = errors.New("media url must be a public http or https address")
+
+// client for media urls, which must not reach internal networks, checked on every dial and redirect
+var mediaClient = &http.Client{
+	Timeout: 30 * time.Second,
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: func(network, address string, c syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if !IsPublicIP(net.ParseIP(host)) {
+					return errMediaAddress
+				}
+				return nil
+			},
+		}).DialContext,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return errors.New("too many redirects")
+		}
+		return checkMediaUrl(req.URL)
+	},
+}
+
+// media_id max count in memory
+var MediaCacheLimit = 1000
+
+// doc: https://mp.weixin.qq.com/wiki?t=resource/res_main&id=mp1444738726
+// doc: https://mp.weixin.qq.com/wiki?t=resource/res_main&id=mp1444738729
+type WechatMediaServer struct {
+	WechatClient
+	mediaMap    *CacheMap
+	materialMap *CacheMap
+}
+
+func NewMediaServer() *WechatMediaServer {
+	srv := new(WechatMediaServer)
+	srv.mediaMap = NewCacheMap(mediaCacheDuration, MediaCacheLimit)
+	srv.materialMap = NewCacheMap(materialCacheDuration, MediaCacheLimit)
+	TrackCache("media", srv.mediaMap)
+	TrackCache("material", srv.materialMap)
+	return srv
+}
+
+// /media/upload?appid=...&secret=...&type=...&url=
+// /material/add?appid=...&secret=...&type=...&url=&title=&introduction=
+// /material/uploadimg?appid=...&secret=...&url=
+func (srv *WechatMediaServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	Debugln(r.RequestURI)
+	r.Body = http.MaxBytesReader(w, r.Body, mediaMaxBody)
+	r.ParseForm()
+	f := r.Form
+	appid, secret := f.Get("appid"), f.Get("secret")
+	media_type := f.Get("type")
+
+	// read media content
+	var name string
+	var data []byte
+	var err error
+	if media_type == "news" {
+		defer r.Body.Close()
+		data, err = ioutil.ReadAll(r.Body)
+	} else {
+		name, data, err = srv.readMedia(r)
+	}
+	if err != nil {
+		w.Write(JsonResponse(err))
+		return
+	}
+
+	// same content uploaded before
+	cache := srv.mediaMap
+	if strings.HasPrefix(r.URL.Path, "/material") {
+		cache = srv.materialMap
+	}
+	key := srv.hashKey(appid, r.URL.Path, media_type, data)
+	if value, ok := cache.Get(key); ok {
+		w.Write(value.([]byte))
+		return
+	}
+
+	access_token, wxErr := srv.GetAccessToken(srv.HostUrl(r), appid, secret)
+	if wxErr != nil {
+		w.Write(wxErr.Serialize())
+		return
+	}
+
+	var body []byte
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/uploadimg"):
+		_url := fmt.Sprintf(ApiBaseUrl+"/cgi-bin/media/uploadimg?access_token=%s", access_token)
+		body, err = srv.postMedia(_url, name, data, nil)
+	case strings.HasPrefix(r.URL.Path, "/material") && media_type == "news":
+		_url := fmt.Sprintf(ApiBaseUrl+"/cgi-bin/material/add_news?access_token=%s", access_token)
+		body, err = srv.postJson(_url, data)
+	case strings.HasPrefix(r.URL.Path, "/material"):
+		_url := fmt.Sprintf(ApiBaseUrl+"/cgi-bin/material/add_material?access_token=%s&type=%s",
+			access_token, media_type)
+		fields := map[string]string{}
+		if media_type == "video" {
+			fields["description"] = fmt.Sprintf(`{"title":%q, "introduction":%q}`, f.Get("title"), f.Get("introduction"))
+		}
+		body, err = srv.postMedia(_url, name, data, fields)
+	default:
+		_url := fmt.Sprintf(ApiBaseUrl+"/cgi-bin/media/upload?access_token=%s&type=%s",
+			access_token, media_type)
+		body, err = srv.postMedia(_url, name, data, nil)
+	}
+	if err != nil {
+		w.Write(JsonResponse(err))
+		return
+	}
+
+	w.Write(body)
+
+	var m wxMedia
+	if json.Unmarshal(body, &m) == nil && m.Success() && (m.MediaId != "" || m.Url != "") {
+		cache.Set(key, body)
+		go cache.Shrink()
+	}
+}
+
+// read media from multipart field "media" or from source url
+func (srv *WechatMediaServer) readMedia(r *http.Request) (name string, data []byte, err error) {
+	src := r.Form.Get("url")
+	if src == "" {
+		file, header, e := r.FormFile("media")
+		if e != nil {
+			err = e
+			return
+		}
+		defer file.Close()
+		name = header.Filename
+		data, err = ioutil.ReadAll(file)
+		return
+	}
+
+	u, err := url.Parse(src)
+	if err != nil {
+		return
+	}
+	err = checkMediaUrl(u)
+	if err != nil {
+		return
+	}
+	resp, err := mediaClient.Get(src)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = errors.New(resp.Status)
+		return
+	}
+	data, err = ioutil.ReadAll(http.MaxBytesReader(nil, resp.Body, mediaMaxSize))
+	if err != nil {
+		return
+	}
+
+	// wechat detects media format by file extension
+	name = path.Base(resp.Request.URL.Path)
+	if path.Ext(name) == "" {
+		exts, _ := mime.ExtensionsByType(resp.Header.Get("Content-Type"))
+		if len(exts) > 0 {
+			name += exts[0]
+		}
+	}
+	return
+}
+
+func checkMediaUrl(u *url.URL) error {
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errMediaAddress
+	}
+	return nil
+}
+
+// IsPublicIP reports whether ip is not loopback, private, link-local or unspecified address.
+func IsPublicIP(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast())
+}
+
+func (srv *WechatMediaServer) hashKey(appid, path, media_type string, data []byte) string {
+	hash := md5.New()
+	hash.Write([]byte(appid + ":" + path + ":" + media_type + ":"))
+	hash.Write(data)
+	return string(hash.Sum(nil))
+}
+
+func (srv *WechatMediaServer) postMedia(url, name string, data []byte, fields map[string]string) (body []byte, err error) {
+	buf := new(bytes.Buffer)
+	mw := multipart.NewWriter(buf)
+	fw, err := mw.CreateFormFile("media", name)
+	if err != nil {
+		return
+	}
+	fw.Write(data)
+	for k, v := range fields {
+		mw.WriteField(k, v)
+	}
+	err = mw.Close()
+	if err != nil {
+		return
+	}
+
+	resp, err := http.Post(url, mw.FormDataContentType(), buf)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	body, err = ioutil.ReadAll(resp.Body)
+	return
+}
+
+func (srv *WechatMediaServer) postJson(url string, data []byte) (body []byte, err error) {
+	resp, err := http.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	body, err = ioutil.ReadAll(resp.Body)
+	return
+}
+
+type wxMedia struct {
+	WxError
+	Type      string `json:"type"`
+	MediaId   string `json:"media_id"`
+	Url       string `json:"url"`
+	CreatedAt uint64 `json:"created_at"`
+}
@@ -0,0 +1,78 @@
+package wechat
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestPostMedia(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file, header, err := r.FormFile("media")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		data, _ := ioutil.ReadAll(file)
+		if header.Filename != "test.jpg" || string(data) != "image data" {
+			t.Fatal("media content error")
+		}
+		if r.FormValue("description") != "desc" {
+			t.Fatal("media field error")
+		}
+		w.Write([]byte(`{"type":"image","media_id":"MEDIA_ID","created_at":123456789}`))
+	}))
+	defer ts.Close()
+
+	srv := NewMediaServer()
+	body, err := srv.postMedia(ts.URL, "test.jpg", []byte("image data"), map[string]string{"description": "desc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != `{"type":"image","media_id":"MEDIA_ID","created_at":123456789}` {
+		t.Fatal("media response error")
+	}
+
+	key1 := srv.hashKey("appid", "/media/upload", "image", []byte("image data"))
+	key2 := srv.hashKey("appid", "/media/upload", "image", []byte("image data"))
+	key3 := srv.hashKey("appid", "/media/upload", "thumb", []byte("image data"))
+	if key1 != key2 || key1 == key3 {
+		t.Fatal("media hash error")
+	}
+}
+
+func TestReadMediaReject(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("internal"))
+	}))
+	defer ts.Close()
+
+	srv := NewMediaServer()
+	for _, src := range []string{ts.URL + "/a.jpg", "file:///etc/passwd", "http://169.254.169.254/latest"} {
+		r := httptest.NewRequest("POST", "/media/upload?type=image&url="+url.QueryEscape(src), nil)
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, r)
+		if !strings.Contains(w.Body.String(), "public http or https") {
+			t.Fatal(src, w.Body.String())
+		}
+	}
+
+	// multipart body over limit
+	body := &bytes.Buffer{}
+	mw := multipart.NewWriter(body)
+	fw, _ := mw.CreateFormFile("media", "big.jpg")
+	fw.Write(make([]byte, mediaMaxBody))
+	mw.Close()
+	r := httptest.NewRequest("POST", "/media/upload?type=image", body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+	if !strings.Contains(w.Body.String(), "too large") {
+		t.Fatal(w.Body.String())
+	}
+}
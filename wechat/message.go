@@ -2,6 +2,8 @@ package wechat
 
 import (
 	"bytes"
+	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"encoding/xml"
 	"fmt"
@@ -13,22 +15,80 @@ import (
 	"time"
 )
 
-const messageRequestTimeout = 5 * time.Second
+// dispatch records kept in memory
+const messageRecentLimit = 200
+
+// timeout of dispatching message to a call url
+var MessageRequestTimeout = 5 * time.Second
+
+// EventHandler receives the plain xml of an event message pushed by wechat.
+type EventHandler func(appid string, msg []byte)
 
 // doc: https://mp.weixin.qq.com/wiki?t=resource/res_main&id=mp1421135319
 type WechatMessageServer struct {
 	WechatClient
+	handlers   map[string][]EventHandler
+	dispatches *recentList
+
+	// Trusted reports whether appid and token of the request are filled by the proxy,
+	// not by the client. event handlers only run for trusted and signed messages.
+	Trusted func(r *http.Request) bool
+
+	// Handler serves relative calls in process with the context of the message request,
+	// relative calls are posted to the host of the request if nil.
+	Handler http.Handler
+}
+
+// MsgDispatch records a message forwarded to a call url.
+type MsgDispatch struct {
+	Time    int64
+	AppId   string
+	MsgType string
+	Event   string
+	Url     string // 不含参数的回调地址
+	Status  int    // http状态码，0表示请求失败
+	Error   string
+	Elapsed int64 // 毫秒
+	Replied bool  // 是否返回了回复消息
 }
 
 func NewMessageServer() *WechatMessageServer {
 	srv := new(WechatMessageServer)
+	srv.handlers = make(map[string][]EventHandler)
+	srv.dispatches = newRecentList(messageRecentLimit)
 	return srv
 }
 
+// Dispatches lists recent dispatches from the newest.
+func (srv *WechatMessageServer) Dispatches() (list []MsgDispatch) {
+	srv.dispatches.Range(func(v interface{}) bool {
+		list = append(list, *v.(*MsgDispatch))
+		return true
+	})
+	return
+}
+
+// HandleEvent registers h to be called for every event of the named type,
+// in addition to the dispatch to calls. Handlers run in their own goroutine, tracked by Wait.
+func (srv *WechatMessageServer) HandleEvent(event string, h EventHandler) {
+	srv.handlers[event] = append(srv.handlers[event], h)
+}
+
 func (srv *WechatMessageServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	log.Println(r.RequestURI)
+	Debugln(r.RequestURI)
 	r.ParseForm()
 
+	// verify signature of wechat, registered apps must have a token
+	f := r.Form
+	signature, timestamp, nonce := f.Get("signature"), f.Get("timestamp"), f.Get("nonce")
+	token, aes_key := f.Get("token"), f.Get("aes")
+	trusted := srv.Trusted != nil && srv.Trusted(r)
+	if token == "" && trusted || token != "" && !checkSignature(token, timestamp, nonce, signature) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write(NewErrorStr("invalid signature").Serialize())
+		return
+	}
+
 	if r.Method == http.MethodGet {
 		echostr := r.Form.Get("echostr")
 		w.Write([]byte(echostr))
@@ -36,11 +96,9 @@ func (srv *WechatMessageServer) ServeHTTP(w http.ResponseWriter, r *http.Request
 	}
 
 	// parse parameters
-	f := r.Form
-	_, timestamp, nonce := f.Get("signature"), f.Get("timestamp"), f.Get("nonce")
 	encrypt_type, msg_signature := f.Get("encrypt_type"), f.Get("msg_signature")
-	token, aes_key := f.Get("token"), f.Get("aes")
 	call_urls := srv.getCalls(r)
+	ctx := r.Context()
 
 	// read body
 	defer r.Body.Close()
@@ -49,16 +107,20 @@ func (srv *WechatMessageServer) ServeHTTP(w http.ResponseWriter, r *http.Request
 		log.Println(err.Error())
 		return
 	}
-	log.Println(string(raw_body))
+	Debugln(string(raw_body))
 
 	if token == "" || aes_key == "" || encrypt_type == "" {
+		if trusted {
+			srv.handleEvent(f.Get("appid"), raw_body)
+		}
+		d := newMsgDispatch(f.Get("appid"), raw_body)
 		if strings.HasSuffix(r.URL.Path, "/msg") {
-			resp_body := srv.dispatchMsg(raw_body, call_urls)
+			resp_body := srv.dispatchMsg(ctx, raw_body, call_urls, d, trusted)
 			w.Write(resp_body)
 			return
 		}
 		if strings.HasSuffix(r.URL.Path, "/json") {
-			resp_body, err := srv.translateMsg(raw_body, call_urls)
+			resp_body, err := srv.translateMsg(ctx, raw_body, call_urls, d, trusted)
 			if err != nil {
 				log.Println(err.Error())
 				return
@@ -69,7 +131,7 @@ func (srv *WechatMessageServer) ServeHTTP(w http.ResponseWriter, r *http.Request
 	}
 
 	// decrypt
-	log.Println("decrypt")
+	Debugln("decrypt")
 	c, err := NewCrypter(token, aes_key)
 	if err != nil {
 		log.Println(err.Error())
@@ -80,14 +142,18 @@ func (srv *WechatMessageServer) ServeHTTP(w http.ResponseWriter, r *http.Request
 		log.Println(err.Error())
 		return
 	}
+	if trusted {
+		srv.handleEvent(appid, msg)
+	}
 
 	// dispatch
 	var reply []byte
+	d := newMsgDispatch(appid, msg)
 	if strings.HasSuffix(r.URL.Path, "/msg") {
-		reply = srv.dispatchMsg(msg, call_urls)
+		reply = srv.dispatchMsg(ctx, msg, call_urls, d, trusted)
 	}
 	if strings.HasSuffix(r.URL.Path, "/json") {
-		reply, err = srv.translateMsg(msg, call_urls)
+		reply, err = srv.translateMsg(ctx, msg, call_urls, d, trusted)
 		if err != nil {
 			log.Println(err.Error())
 			return
@@ -103,8 +169,39 @@ func (srv *WechatMessageServer) ServeHTTP(w http.ResponseWriter, r *http.Request
 	w.Write(resp_body)
 }
 
+// signature of wechat: sha1 of sorted token, timestamp and nonce
+func checkSignature(token, timestamp, nonce, signature string) bool {
+	expected := new(wechatMsgCrypter).sha1Signature(token, timestamp, nonce)
+	return subtle.ConstantTimeCompare([]byte(strings.ToLower(signature)), []byte(expected)) == 1
+}
+
+// call registered event handlers
+func (srv *WechatMessageServer) handleEvent(appid string, msg []byte) {
+	var m struct {
+		MsgType string
+		Event   string
+	}
+	if xml.Unmarshal(msg, &m) != nil || m.MsgType != "event" {
+		return
+	}
+	for _, h := range srv.handlers[m.Event] {
+		h := h
+		Go(func() { h(appid, msg) })
+	}
+}
+
+// dispatch record of plain xml message
+func newMsgDispatch(appid string, msg []byte) MsgDispatch {
+	var m struct {
+		MsgType string
+		Event   string
+	}
+	xml.Unmarshal(msg, &m)
+	return MsgDispatch{AppId: appid, MsgType: m.MsgType, Event: m.Event}
+}
+
 // dispatch json message
-func (srv *WechatMessageServer) translateMsg(msg []byte, urls []string) (reply []byte, err error) {
+func (srv *WechatMessageServer) translateMsg(ctx context.Context, msg []byte, urls []string, d MsgDispatch, trusted bool) (reply []byte, err error) {
 	var m WxMessage
 	err = xml.Unmarshal(msg, &m)
 	if err != nil {
@@ -129,7 +226,7 @@ func (srv *WechatMessageServer) translateMsg(msg []byte, urls []string) (reply [
 		}
 	}
 
-	reply_js := srv.dispatchMsg(msg_js, urls)
+	reply_js := srv.dispatchMsg(ctx, msg_js, urls, d, trusted)
 	if len(reply_js) == 0 {
 		reply = reply_js
 		return
@@ -144,32 +241,43 @@ func (srv *WechatMessageServer) translateMsg(msg []byte, urls []string) (reply [
 	return
 }
 
-// dispatch message body to calls url
-func (srv *WechatMessageServer) dispatchMsg(body []byte, urls []string) (result []byte) {
+// dispatch message body to calls url, calls of trusted requests are labeled by host in metrics
+func (srv *WechatMessageServer) dispatchMsg(ctx context.Context, body []byte, urls []string, d MsgDispatch, trusted bool) (result []byte) {
 
 	chs := make([]chan []byte, len(urls))
 	for i, _url := range urls {
-		chs[i] = make(chan []byte)
+		chs[i] = make(chan []byte, 1)
 
 		go func(url string, data []byte, ch chan []byte) {
 			defer close(ch)
 
-			client := &http.Client{
-				Timeout: messageRequestTimeout,
-			}
-			resp, err := client.Post(url, "", bytes.NewReader(data))
+			// record without query, which contains secret
+			start := time.Now()
+			d := d
+			d.Time = start.Unix()
+			d.Url = strings.SplitN(url, "?", 2)[0]
+			backend := backendLabel(d.Url, trusted)
+			defer func() {
+				elapsed := time.Since(start)
+				d.Elapsed = int64(elapsed / time.Millisecond)
+				srv.dispatches.Add(&d)
+				dispatchSeconds.WithLabelValues(backend).Observe(elapsed.Seconds())
+			}()
+
+			status, resp_data, err := srv.postCall(ctx, url, data)
 			if err != nil {
+				d.Error = err.Error()
+				if isTimeout(err) {
+					dispatchTimeoutTotal.WithLabelValues(backend).Inc()
+				}
 				return
 			}
-			defer resp.Body.Close()
 
-			if resp.StatusCode != http.StatusOK {
-				return
-			}
-			resp_data, err := ioutil.ReadAll(resp.Body)
-			if err != nil {
+			d.Status = status
+			if status != http.StatusOK {
 				return
 			}
+			d.Replied = len(resp_data) > 0
 
 			ch <- resp_data
 		}(_url, body, chs[i])
@@ -184,6 +292,67 @@ func (srv *WechatMessageServer) dispatchMsg(body []byte, urls []string) (result
 	return
 }
 
+// post message to call url, relative urls are served in process by Handler
+func (srv *WechatMessageServer) postCall(ctx context.Context, url string, data []byte) (status int, body []byte, err error) {
+	if !strings.HasPrefix(url, "/") {
+		client := &http.Client{
+			Timeout: MessageRequestTimeout,
+		}
+		resp, err := client.Post(url, "", bytes.NewReader(data))
+		if err != nil {
+			return 0, nil, err
+		}
+		defer resp.Body.Close()
+		body, err = ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, body, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, MessageRequestTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+	resp := &callResponse{header: make(http.Header)}
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		srv.Handler.ServeHTTP(resp, req)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		return
+	}
+	if resp.status == 0 {
+		resp.status = http.StatusOK
+	}
+	return resp.status, resp.body.Bytes(), nil
+}
+
+// response of a call served in process
+type callResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (c *callResponse) Header() http.Header {
+	return c.header
+}
+
+func (c *callResponse) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+	}
+}
+
+func (c *callResponse) Write(b []byte) (int, error) {
+	c.WriteHeader(http.StatusOK)
+	return c.body.Write(b)
+}
+
 func (srv *WechatMessageServer) getCalls(r *http.Request) []string {
 	// prepare callback urls
 	calls := r.Form["call"]
@@ -223,10 +392,12 @@ func (srv *WechatMessageServer) msgQuery(r *http.Request) string {
 	return query
 }
 
-// Get absolute url contain http:// or https://
+// Get absolute url contain http:// or https://, relative urls are kept if served in process
 func (srv *WechatMessageServer) normalizeUrl(r *http.Request, url string, query string) string {
 	if strings.HasPrefix(url, "/") {
-		url = srv.HostUrl(r) + url
+		if srv.Handler == nil {
+			url = srv.HostUrl(r) + url
+		}
 	} else if !strings.HasPrefix(url, "http") {
 		url = "http://" + url
 	}
@@ -59,6 +59,8 @@ func init() {
 	}
 	wxEventsMap["ShakearoundUserShake"] = reflect.TypeOf(wxEventBeacon{})
 	wxEventsMap["WifiConnected"] = reflect.TypeOf(wxEventWifi{})
+	wxEventsMap["TEMPLATESENDJOBFINISH"] = reflect.TypeOf(wxEventTemplate{})
+	wxEventsMap["MASSSENDJOBFINISH"] = reflect.TypeOf(wxEventMass{})
 
 	for _, v := range event_maps {
 		for _, name := range v.Names {
@@ -202,6 +204,24 @@ type wxEventWifi struct {
 	DeviceNo    string
 }
 
+// https://mp.weixin.qq.com/wiki?t=resource/res_main&id=mp1433751277
+type wxEventTemplate struct {
+	wxEvent
+	MsgID  uint64
+	Status CDATA
+}
+
+// https://mp.weixin.qq.com/wiki?t=resource/res_main&id=mp1481187827_i0l21
+type wxEventMass struct {
+	wxEvent
+	MsgID       uint64
+	Status      CDATA
+	TotalCount  uint32
+	FilterCount uint32
+	SentCount   uint32
+	ErrorCount  uint32
+}
+
 // json to xml
 // https://mp.weixin.qq.com/wiki?t=resource/res_main&id=mp1421140543
 type WxReply struct {
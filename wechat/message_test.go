@@ -1,12 +1,15 @@
 package wechat
 
 import (
+	"context"
+	"encoding/xml"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestMessageServer(t *testing.T) {
@@ -117,3 +120,138 @@ func TestMessageServer(t *testing.T) {
 		}
 	}
 }
+
+func TestMessageEvent(t *testing.T) {
+	srv := NewMessageServer()
+	srv.Trusted = func(r *http.Request) bool { return r.Header.Get("X-Trusted") != "" }
+	ch := make(chan uint64, 1)
+	srv.HandleEvent("TEMPLATESENDJOBFINISH", func(appid string, msg []byte) {
+		var e wxEventTemplate
+		err := xml.Unmarshal(msg, &e)
+		if err != nil || appid != "wx06766a90ab72960e" {
+			ch <- 0
+			return
+		}
+		ch <- e.MsgID
+	})
+
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+
+	body := `<xml>
+<ToUserName><![CDATA[gh_7f083739789a]]></ToUserName>
+<FromUserName><![CDATA[oia2TjuEGTNoeX76QEjQNrcURxG8]]></FromUserName>
+<CreateTime>1395658920</CreateTime>
+<MsgType><![CDATA[event]]></MsgType>
+<Event><![CDATA[TEMPLATESENDJOBFINISH]]></Event>
+<MsgID>200163836</MsgID>
+<Status><![CDATA[success]]></Status>
+</xml>`
+	sign := new(wechatMsgCrypter).sha1Signature("token", "1395658920", "nonce")
+	signed := "/msg?appid=wx06766a90ab72960e&token=token&timestamp=1395658920&nonce=nonce&signature="
+
+	ts_data := []struct {
+		Url     string
+		Trusted bool
+		Status  int
+		Handled bool
+	}{
+		{signed + sign, true, http.StatusOK, true},
+		{signed + "forged", true, http.StatusForbidden, false},
+		{"/msg?appid=wx06766a90ab72960e", true, http.StatusForbidden, false},
+		{signed + sign, false, http.StatusOK, false},
+		{"/msg?appid=wx06766a90ab72960e", false, http.StatusOK, false},
+	}
+	for _, v := range ts_data {
+		req, _ := http.NewRequest("POST", ts.URL+v.Url, strings.NewReader(body))
+		if v.Trusted {
+			req.Header.Set("X-Trusted", "1")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != v.Status {
+			t.Fatal(v, resp.StatusCode)
+		}
+
+		select {
+		case msgid := <-ch:
+			if !v.Handled || msgid != 200163836 {
+				t.Fatal(v, "event handler error")
+			}
+		case <-time.After(200 * time.Millisecond):
+			if v.Handled {
+				t.Fatal(v, "event handler timeout")
+			}
+		}
+	}
+}
+
+func TestMessageCallInProcess(t *testing.T) {
+	type ctxKey struct{}
+	mux := http.NewServeMux()
+	srv := NewMessageServer()
+	srv.Handler = mux
+	mux.Handle("/msg", srv)
+	mux.HandleFunc("/svc", func(w http.ResponseWriter, r *http.Request) {
+		// context of the message request is passed to the call
+		if r.Context().Value(ctxKey{}) == nil || r.URL.Query().Get("appid") != "wx1" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Write(body)
+	})
+
+	r := httptest.NewRequest("POST", "/msg?appid=wx1&call=/svc", strings.NewReader("<xml>...</xml>"))
+	r = r.WithContext(context.WithValue(r.Context(), ctxKey{}, true))
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	if w.Body.String() != "<xml>...</xml>" {
+		t.Fatal(w.Body.String())
+	}
+	if list := srv.Dispatches(); len(list) != 1 || list[0].Url != "/svc" || list[0].Status != http.StatusOK {
+		t.Fatal(list)
+	}
+}
+
+func TestMessageDispatches(t *testing.T) {
+	mux := http.NewServeMux()
+	srv := NewMessageServer()
+	mux.Handle("/msg", srv)
+	mux.HandleFunc("/svc", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<xml>reply</xml>"))
+	})
+	mux.HandleFunc("/fail", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "fail", http.StatusInternalServerError)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	body := `<xml><MsgType><![CDATA[event]]></MsgType><Event><![CDATA[subscribe]]></Event></xml>`
+	url := ts.URL + "/msg?appid=wx1&secret=s1&call=" + ts.URL[7:] + "/svc&call=" + ts.URL[7:] + "/fail"
+	resp, err := http.Post(url, "", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// the failed call may be recorded after the reply
+	time.Sleep(100 * time.Millisecond)
+	list := srv.Dispatches()
+	if len(list) != 2 {
+		t.Fatal(list)
+	}
+	status := map[string]int{}
+	for _, d := range list {
+		if d.AppId != "wx1" || d.MsgType != "event" || d.Event != "subscribe" || strings.Contains(d.Url, "s1") {
+			t.Fatal(d)
+		}
+		status[d.Url[len(ts.URL):]] = d.Status
+	}
+	if status["/svc"] != http.StatusOK || status["/fail"] != http.StatusInternalServerError {
+		t.Fatal(status)
+	}
+}
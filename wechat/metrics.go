@@ -0,0 +1,203 @@
+package wechat
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	tokenCacheTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "wxproxy_token_cache_total",
+		Help: "access_token requests by cache result: hit, miss, refresh. appid is \"other\" if the token is not issued.",
+	}, []string{"appid", "result"})
+
+	upstreamSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "wxproxy_upstream_request_seconds",
+		Help:    "Latency of requests to wechat api.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"host", "path"})
+
+	upstreamErrcodeTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "wxproxy_upstream_errcode_total",
+		Help: "Responses of wechat api by errcode, -1 means request failed.",
+	}, []string{"host", "path", "errcode"})
+
+	dispatchSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "wxproxy_dispatch_seconds",
+		Help:    "Latency of dispatching messages by host of call urls, \"local\" for calls served in process.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"backend"})
+
+	dispatchTimeoutTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "wxproxy_dispatch_timeouts_total",
+		Help: "Message dispatches exceeding the message timeout.",
+	}, []string{"backend"})
+
+	payOrderTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "wxproxy_pay_orders_total",
+		Help: "Pay orders by status: created, notified, failed (notify failed).",
+	}, []string{"appid", "status"})
+
+	authFlowTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "wxproxy_auth_flows_total",
+		Help: "Oauth flows by stage: started (code exchanged), completed.",
+	}, []string{"appid", "stage"})
+)
+
+func init() {
+	prometheus.MustRegister(caches)
+}
+
+// caches reports item count of named cache maps
+var caches = &cacheCollector{
+	desc: prometheus.NewDesc("wxproxy_cache_items", "Items in memory caches, including expired ones.", []string{"cache"}, nil),
+	m:    make(map[string]*CacheMap),
+}
+
+type cacheCollector struct {
+	desc *prometheus.Desc
+	m    map[string]*CacheMap
+	lock sync.Mutex
+}
+
+// TrackCache reports item count of tm as wxproxy_cache_items{cache=name},
+// it replaces the cache of the same name, so the latest created server is reported.
+func TrackCache(name string, tm *CacheMap) {
+	caches.lock.Lock()
+	defer caches.lock.Unlock()
+	caches.m[name] = tm
+}
+
+func (c *cacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *cacheCollector) Collect(ch chan<- prometheus.Metric) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for name, tm := range c.m {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(tm.Len()), name)
+	}
+}
+
+// label of appids not validated by wechat and backends of unregistered calls,
+// so clients can't create unbounded series.
+const metricOther = "other"
+
+// backend of call url: host of calls of registered apps, "local" for calls served in process
+func backendLabel(callUrl string, trusted bool) string {
+	if strings.HasPrefix(callUrl, "/") {
+		return "local"
+	}
+	if !trusted {
+		return metricOther
+	}
+	u, err := url.Parse(callUrl)
+	if err != nil || u.Host == "" {
+		return metricOther
+	}
+	return u.Host
+}
+
+func isTimeout(err error) bool {
+	e, ok := err.(net.Error)
+	return ok && e.Timeout()
+}
+
+// NewMetricsTransport observes latency and errcode of requests to wechat api (base urls),
+// other requests are passed through.
+func NewMetricsTransport(base http.RoundTripper) http.RoundTripper {
+	return &metricsTransport{base}
+}
+
+type metricsTransport struct {
+	base http.RoundTripper
+}
+
+func (t *metricsTransport) RoundTrip(r *http.Request) (resp *http.Response, err error) {
+	if !isUpstream(r.URL.Host) {
+		return t.base.RoundTrip(r)
+	}
+
+	start := time.Now()
+	errcode := "-1"
+	defer func() {
+		upstreamSeconds.WithLabelValues(r.URL.Host, r.URL.Path).Observe(time.Since(start).Seconds())
+		upstreamErrcodeTotal.WithLabelValues(r.URL.Host, r.URL.Path, errcode).Inc()
+	}()
+
+	resp, err = t.base.RoundTrip(r)
+	if err != nil {
+		return
+	}
+	errcode = "0"
+	if !hasErrcode(resp.Header.Get("Content-Type")) {
+		return
+	}
+
+	// read body for errcode, then restore it
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		errcode = "-1"
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	errcode = parseErrcode(body)
+	return
+}
+
+func isUpstream(host string) bool {
+	for _, base := range []string{ApiBaseUrl, OpenBaseUrl, MpBaseUrl, PayBaseUrl} {
+		u, err := url.Parse(base)
+		if err == nil && u.Host == host {
+			return true
+		}
+	}
+	return false
+}
+
+// json and xml responses, wechat returns json as text/plain sometimes
+func hasErrcode(contentType string) bool {
+	for _, t := range []string{"json", "xml", "text/plain"} {
+		if strings.Contains(contentType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// errcode of json, err_code or return_code of pay xml, "0" if absent
+func parseErrcode(body []byte) string {
+	var js struct {
+		ErrCode int `json:"errcode"`
+	}
+	if json.Unmarshal(body, &js) == nil {
+		return strconv.Itoa(js.ErrCode)
+	}
+	var x struct {
+		ReturnCode string `xml:"return_code"`
+		ErrCode    string `xml:"err_code"`
+	}
+	if xml.Unmarshal(body, &x) == nil {
+		if x.ErrCode != "" {
+			return x.ErrCode
+		}
+		if x.ReturnCode != "" && x.ReturnCode != payResultSuccess {
+			return x.ReturnCode
+		}
+	}
+	return "0"
+}
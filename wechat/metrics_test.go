@@ -0,0 +1,135 @@
+package wechat
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricsTransport(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(`{"errcode":40013,"errmsg":"invalid appid"}`))
+	}))
+	defer ts.Close()
+
+	defer func(base string) { ApiBaseUrl = base }(ApiBaseUrl)
+	ApiBaseUrl = ts.URL
+	host := ts.URL[len("http://"):]
+
+	client := &http.Client{Transport: NewMetricsTransport(http.DefaultTransport)}
+	resp, err := client.Get(ts.URL + "/cgi-bin/token?appid=wx1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var e WxError
+	err = json.NewDecoder(resp.Body).Decode(&e)
+	resp.Body.Close()
+	if err != nil || e.ErrCode != 40013 {
+		t.Fatal("body is not restored", e, err)
+	}
+
+	if n := testutil.ToFloat64(upstreamErrcodeTotal.WithLabelValues(host, "/cgi-bin/token", "40013")); n != 1 {
+		t.Fatal(n)
+	}
+	if n := testutil.CollectAndCount(upstreamSeconds); n == 0 {
+		t.Fatal("latency is not observed")
+	}
+}
+
+func TestParseErrcode(t *testing.T) {
+	ts_data := []struct {
+		Body    string
+		Errcode string
+	}{
+		{`{"access_token":"t","expires_in":7200}`, "0"},
+		{`{"errcode":45009,"errmsg":"api freq out of limit"}`, "45009"},
+		{`<xml><return_code>SUCCESS</return_code><err_code>ORDERPAID</err_code></xml>`, "ORDERPAID"},
+		{`<xml><return_code>FAIL</return_code></xml>`, "FAIL"},
+		{`not json`, "0"},
+	}
+	for _, v := range ts_data {
+		if code := parseErrcode([]byte(v.Body)); code != v.Errcode {
+			t.Fatal(v, code)
+		}
+	}
+}
+
+func TestMetricsDispatchTimeout(t *testing.T) {
+	mux := http.NewServeMux()
+	srv := NewMessageServer()
+	mux.Handle("/msg", srv)
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	defer func(timeout time.Duration) { MessageRequestTimeout = timeout }(MessageRequestTimeout)
+	MessageRequestTimeout = 50 * time.Millisecond
+
+	body := `<xml><MsgType><![CDATA[text]]></MsgType></xml>`
+	resp, err := http.Post(ts.URL+"/msg?appid=wx1&call="+ts.URL[7:]+"/slow", "", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// calls of untrusted requests share one label
+	if n := testutil.ToFloat64(dispatchTimeoutTotal.WithLabelValues(metricOther)); n != 1 {
+		t.Fatal(n)
+	}
+}
+
+func TestMetricsLabels(t *testing.T) {
+	ts_data := []struct {
+		Url     string
+		Trusted bool
+		Label   string
+	}{
+		{"http://example.com:8080/msg", true, "example.com:8080"},
+		{"http://example.com/msg", false, metricOther},
+		{"/app/test/user", true, "local"},
+		{"/user", false, "local"},
+	}
+	for _, v := range ts_data {
+		if label := backendLabel(v.Url, v.Trusted); label != v.Label {
+			t.Fatal(v, label)
+		}
+	}
+
+	// appid is labeled only when token is issued
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("appid") != "wx-valid" {
+			w.Write([]byte(`{"errcode":40013,"errmsg":"invalid appid"}`))
+			return
+		}
+		w.Write([]byte(`{"access_token":"TOKEN","expires_in":7200}`))
+	}))
+	defer ts.Close()
+	defer func(base string) { ApiBaseUrl = base }(ApiBaseUrl)
+	ApiBaseUrl = ts.URL
+
+	srv := NewApiServer()
+	series := testutil.CollectAndCount(tokenCacheTotal)
+	other := testutil.ToFloat64(tokenCacheTotal.WithLabelValues(metricOther, "miss"))
+	for _, appid := range []string{"wx-valid", "wx-forged1", "wx-forged2"} {
+		srv.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/api?appid="+appid+"&secret=s", nil))
+	}
+	if n := testutil.ToFloat64(tokenCacheTotal.WithLabelValues("wx-valid", "miss")); n != 1 {
+		t.Fatal(n)
+	}
+	if n := testutil.ToFloat64(tokenCacheTotal.WithLabelValues(metricOther, "miss")); n != other+2 {
+		t.Fatal(n)
+	}
+
+	// forged appids add no series
+	if n := testutil.CollectAndCount(tokenCacheTotal); n > series+2 {
+		t.Fatal(n, series)
+	}
+}
@@ -21,22 +21,77 @@ const (
 	payResultSuccess = "SUCCESS"
 
 	payCacheDuration = 2 * time.Hour
-	payCacheLimit    = 1000
+
+	// order records kept in memory
+	payRecentLimit = 200
 )
 
+// unpaid orders max count in memory
+var PayCacheLimit = 1000
+
 type WechatPayServer struct {
 	WechatClient
 	notifyMap *CacheMap
+	orders    *recentList
+}
+
+// PayOrder records an order made by pay server and the delivery of its result.
+type PayOrder struct {
+	AppId        string
+	MchId        string
+	OutTradeNo   string
+	TotalFee     string
+	Body         string
+	TradeType    string
+	CreateTime   int64
+	Paid         bool   // 已收到支付结果
+	TimeEnd      string // 支付完成时间
+	CallUrl      string // 不含参数的回调地址
+	NotifyStatus string // 回调状态: ok, failed, 空表示未回调
+	NotifyError  string
+	NotifyTime   int64
 }
 
 func NewPayServer() *WechatPayServer {
 	srv := new(WechatPayServer)
-	srv.notifyMap = NewCacheMap(payCacheDuration, payCacheLimit)
+	srv.notifyMap = NewCacheMap(payCacheDuration, PayCacheLimit)
+	srv.orders = newRecentList(payRecentLimit)
+	TrackCache("pay", srv.notifyMap)
 	return srv
 }
 
+// Orders lists recent orders from the newest.
+func (srv *WechatPayServer) Orders() (list []PayOrder) {
+	srv.orders.Range(func(v interface{}) bool {
+		list = append(list, *v.(*PayOrder))
+		return true
+	})
+	return
+}
+
+// update order by pay result and notify error
+func (srv *WechatPayServer) setNotify(result *wxPayResult, notified bool, err error) {
+	srv.orders.Range(func(v interface{}) bool {
+		o := v.(*PayOrder)
+		if o.MchId+o.OutTradeNo != result.Key() {
+			return true
+		}
+		o.Paid = result.Result_code == payResultSuccess
+		o.TimeEnd = result.Time_end
+		if notified {
+			o.NotifyStatus = "ok"
+			o.NotifyTime = time.Now().Unix()
+			if err != nil {
+				o.NotifyStatus = "failed"
+				o.NotifyError = err.Error()
+			}
+		}
+		return false
+	})
+}
+
 func (srv *WechatPayServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	log.Println(r.RequestURI)
+	Debugln(r.RequestURI)
 
 	// pay result callback
 	if strings.HasSuffix(r.URL.Path, "/pay") &&
@@ -70,8 +125,20 @@ func (srv *WechatPayServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// store param
 	srv.notifyMap.Set(p.Key(), *p)
 	defer srv.notifyMap.Shrink()
-	log.Printf("set key: %s\n", p.Key())
-	log.Printf("call_url: %s\n", p.Call_url)
+	// orders are counted after wechat accepts them, so appid is validated
+	payOrderTotal.WithLabelValues(p.AppId, "created").Inc()
+	srv.orders.Add(&PayOrder{
+		AppId:      p.AppId,
+		MchId:      p.Mch_id,
+		OutTradeNo: p.Out_trade_no,
+		TotalFee:   p.Total_fee,
+		Body:       p.Body,
+		TradeType:  p.Trade_type,
+		CreateTime: time.Now().Unix(),
+		CallUrl:    strings.SplitN(p.Call_url, "?", 2)[0],
+	})
+	Debugf("set key: %s\n", p.Key())
+	Debugf("call_url: %s\n", p.Call_url)
 
 	if strings.HasSuffix(r.URL.Path, "/pay") {
 		w.Write(JsonResponse(order))
@@ -222,7 +289,7 @@ func (srv *WechatPayServer) sendParam(p *wxPayParam) (r *wxPayOrder, err error)
 		return
 	}
 
-	_url := "https://api.mch.weixin.qq.com/pay/unifiedorder"
+	_url := PayBaseUrl + "/pay/unifiedorder"
 	resp, err := http.Post(_url, "", bytes.NewReader(bs))
 	if err != nil {
 		return
@@ -274,7 +341,19 @@ func (srv *WechatPayServer) notifyResult(r *http.Request) (data []byte, err erro
 		return
 	}
 	p := v.(wxPayParam)
-	if p.Call_url == "" {
+	notified := p.Call_url != ""
+	defer func() {
+		srv.setNotify(result, notified, err)
+		if !notified {
+			return
+		}
+		status := "notified"
+		if err != nil {
+			status = "failed"
+		}
+		payOrderTotal.WithLabelValues(p.AppId, status).Inc()
+	}()
+	if !notified {
 		return
 	}
 
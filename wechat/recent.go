@@ -0,0 +1,37 @@
+package wechat
+
+import "sync"
+
+// recent records kept in memory, the oldest is dropped when limit is reached.
+type recentList struct {
+	items []interface{}
+	limit int
+	lock  sync.Mutex
+}
+
+func newRecentList(limit int) *recentList {
+	l := new(recentList)
+	l.limit = limit
+	return l
+}
+
+func (l *recentList) Add(v interface{}) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.items = append(l.items, v)
+	if len(l.items) > l.limit {
+		l.items = l.items[len(l.items)-l.limit:]
+	}
+}
+
+// Range calls f for each item from the newest, stop when f returns false.
+// f is called with lock held, so it may modify the item safely.
+func (l *recentList) Range(f func(v interface{}) bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for i := len(l.items) - 1; i >= 0; i-- {
+		if !f(l.items[i]) {
+			return
+		}
+	}
+}
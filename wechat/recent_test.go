@@ -0,0 +1,18 @@
+package wechat
+
+import "testing"
+
+func TestRecentList(t *testing.T) {
+	l := newRecentList(3)
+	for i := 1; i <= 5; i++ {
+		l.Add(i)
+	}
+	var items []int
+	l.Range(func(v interface{}) bool {
+		items = append(items, v.(int))
+		return true
+	})
+	if len(items) != 3 || items[0] != 5 || items[2] != 3 {
+		t.Fatal(items)
+	}
+}
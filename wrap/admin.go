@@ -0,0 +1,384 @@
+package wrap
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	wx "wechat-proxy/wechat"
+)
+
+// secret parameters are only accepted in request body
+var adminSecretParams = []string{"secret", "token", "aes", "mch_key", "client_secret"}
+
+// REST api for registered apps and proxy status, only admin token is accepted.
+type AdminServer struct {
+	wx.WechatClient
+	AdminToken string
+
+	// status sources, nil means unavailable
+	ApiServer *wx.WechatApiServer
+	MsgServer *wx.WechatMessageServer
+	PayServer *wx.WechatPayServer
+}
+
+func NewAdminServer() *AdminServer {
+	return &AdminServer{}
+}
+
+// app fields in request body, nil means unchanged
+type appForm struct {
+	Key         *string  `json:"key"`
+	AppId       *string  `json:"appid"`
+	Secret      *string  `json:"secret"`
+	Token       *string  `json:"token"`
+	AesKey      *string  `json:"aes"`
+	MchId       *string  `json:"mch_id"`
+	MchKey      *string  `json:"mch_key"`
+	IpAddress   *string  `json:"server_ip"`
+	Calls       []string `json:"calls"`
+	AllowIps    []string `json:"allow_ips"`
+	Unsigned    *bool    `json:"unsigned"`
+	Expires     *int64   `json:"expires"` // 有效期(秒)，0表示永久
+	Owner       *string  `json:"owner"`
+	ResetSecret bool     `json:"reset_secret"`
+}
+
+// app in response, secrets are masked
+type appView struct {
+	*WxApp
+	Expired   bool
+	NewSecret string `json:"client_secret,omitempty"` // only returned when issued
+}
+
+// GET /admin/tokens
+// GET /admin/messages?appid=
+// GET /admin/orders?appid=
+// GET /admin/users?appid=...&(parameters of /user)
+// and /admin/apps...
+func (srv *AdminServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	wx.Debugln(r.URL.Path)
+
+	if !isAdminToken(headerToken(r), srv.AdminToken) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write(wx.NewErrorStr("unauthorized").Serialize())
+		return
+	}
+	query := r.URL.Query()
+	for _, k := range adminSecretParams {
+		if _, ok := query[k]; ok {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(wx.NewErrorStr(k + " must be posted in request body").Serialize())
+			return
+		}
+	}
+
+	if strings.HasPrefix(r.URL.Path, "/admin/apps") {
+		srv.apps(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write(wx.NewErrorStr("method not allowed").Serialize())
+		return
+	}
+	appid := query.Get("appid")
+	switch r.URL.Path {
+	case "/admin/tokens":
+		var tokens []wx.TokenStatus
+		if srv.ApiServer != nil {
+			tokens = srv.ApiServer.Tokens()
+		}
+		w.Write(wx.JsonResponse(tokens))
+	case "/admin/messages":
+		var list []wx.MsgDispatch
+		if srv.MsgServer != nil {
+			for _, d := range srv.MsgServer.Dispatches() {
+				if appid == "" || d.AppId == appid {
+					list = append(list, d)
+				}
+			}
+		}
+		w.Write(wx.JsonResponse(list))
+	case "/admin/orders":
+		var list []wx.PayOrder
+		if srv.PayServer != nil {
+			for _, o := range srv.PayServer.Orders() {
+				if appid == "" || o.AppId == appid {
+					list = append(list, o)
+				}
+			}
+		}
+		w.Write(wx.JsonResponse(list))
+	case "/admin/users":
+		queryUsers(w, parseUserQuery(query))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// GET    /admin/apps?offset=&limit=&owner=
+// POST   /admin/apps
+// GET    /admin/apps/<key>
+// PATCH  /admin/apps/<key>
+// DELETE /admin/apps/<key>
+// POST   /admin/apps/<key>/renew
+// GET    /admin/apps/<key>/usage
+func (srv *AdminServer) apps(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/admin/apps"), "/"), "/")
+	key, action := parts[0], ""
+	if len(parts) > 1 {
+		action = parts[1]
+	}
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		srv.list(w, r)
+	case key == "" && r.Method == http.MethodPost:
+		srv.create(w, r)
+	case len(parts) > 2 || key == "":
+		http.NotFound(w, r)
+	case action == "" && r.Method == http.MethodGet:
+		srv.get(w, key)
+	case action == "" && r.Method == http.MethodPatch:
+		srv.patch(w, r, key)
+	case action == "" && r.Method == http.MethodDelete:
+		srv.delete(w, key)
+	case action == "renew" && r.Method == http.MethodPost:
+		srv.renew(w, r, key)
+	case action == "usage" && r.Method == http.MethodGet:
+		srv.usage(w, key)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write(wx.NewErrorStr("method not allowed").Serialize())
+	}
+}
+
+func (srv *AdminServer) list(w http.ResponseWriter, r *http.Request) {
+	f := r.URL.Query()
+	offset, _ := strconv.Atoi(f.Get("offset"))
+	limit, _ := strconv.Atoi(f.Get("limit"))
+	if offset < 0 {
+		offset = 0
+	}
+	if limit <= 0 {
+		limit = queryDefaultLimit
+	}
+	if limit > queryMaxLimit {
+		limit = queryMaxLimit
+	}
+
+	apps, err := NewStorage().LoadApps()
+	if err != nil {
+		w.Write(wx.JsonResponse(err))
+		return
+	}
+	views := make([]*appView, 0, limit)
+	total := 0
+	for _, app := range apps {
+		if owner, ok := f["owner"]; ok && app.Owner != owner[0] {
+			continue
+		}
+		if total >= offset && len(views) < limit {
+			views = append(views, newAppView(app))
+		}
+		total++
+	}
+	w.Write(wx.JsonResponse(&struct {
+		Total int
+		Apps  []*appView
+	}{total, views}))
+}
+
+func (srv *AdminServer) get(w http.ResponseWriter, key string) {
+	app, err := NewStorage().LoadApp(key)
+	if err != nil && err != ErrExpired {
+		writeStorageError(w, err)
+		return
+	}
+	w.Write(wx.JsonResponse(newAppView(app)))
+}
+
+func (srv *AdminServer) create(w http.ResponseWriter, r *http.Request) {
+	form, err := readAppForm(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(wx.JsonResponse(err))
+		return
+	}
+	if form.Key == nil || *form.Key == "" || form.AppId == nil || form.Secret == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(wx.NewErrorStr("key, appid and secret are required").Serialize())
+		return
+	}
+	if _, err := NewStorage().LoadApp(*form.Key); err != ErrNotFound {
+		w.WriteHeader(http.StatusConflict)
+		w.Write(wx.NewErrorStr("key exists").Serialize())
+		return
+	}
+
+	app := &WxApp{Key: *form.Key}
+	form.ResetSecret = true
+	srv.save(w, r, app, form)
+}
+
+func (srv *AdminServer) patch(w http.ResponseWriter, r *http.Request, key string) {
+	form, err := readAppForm(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(wx.JsonResponse(err))
+		return
+	}
+	app, err := NewStorage().LoadApp(key)
+	if err != nil && err != ErrExpired {
+		writeStorageError(w, err)
+		return
+	}
+	if form.Key != nil && *form.Key != key {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(wx.NewErrorStr("key can not be changed").Serialize())
+		return
+	}
+	srv.save(w, r, app, form)
+}
+
+// merge form into app, check appid and secret if changed, then store it
+func (srv *AdminServer) save(w http.ResponseWriter, r *http.Request, app *WxApp, form *appForm) {
+	checkSecret := form.AppId != nil || form.Secret != nil
+	if form.AppId != nil {
+		app.AppId = *form.AppId
+	}
+	if form.Secret != nil {
+		app.Secret = *form.Secret
+	}
+	if form.Token != nil {
+		app.Token = *form.Token
+	}
+	if form.AesKey != nil {
+		app.AesKey = *form.AesKey
+	}
+	if form.MchId != nil {
+		app.MchId = *form.MchId
+	}
+	if form.MchKey != nil {
+		app.MchKey = *form.MchKey
+	}
+	if form.IpAddress != nil {
+		app.IpAddress = *form.IpAddress
+	}
+	if form.Calls != nil {
+		app.setCalls(form.Calls)
+	}
+	if form.AllowIps != nil {
+		app.setAllowIps(form.AllowIps)
+	}
+	if form.Unsigned != nil {
+		app.Unsigned = *form.Unsigned
+	}
+	if form.Expires != nil {
+		app.renew(*form.Expires)
+	}
+	if form.Owner != nil {
+		app.Owner = *form.Owner
+	}
+
+	if checkSecret {
+		_, wxErr := srv.GetAccessToken(srv.HostUrl(r), app.AppId, app.Secret)
+		if wxErr != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write(wxErr.Serialize())
+			return
+		}
+	}
+
+	clientSecret := ""
+	if form.ResetSecret {
+		var err error
+		clientSecret, err = randomKey()
+		if err != nil {
+			w.Write(wx.JsonResponse(err))
+			return
+		}
+		app.ClientSecret = clientSecret
+	}
+
+	err := NewStorage().SaveApp(app)
+	if err != nil {
+		w.Write(wx.JsonResponse(err))
+		return
+	}
+	view := newAppView(app)
+	view.NewSecret = clientSecret
+	w.Write(wx.JsonResponse(view))
+}
+
+func (srv *AdminServer) delete(w http.ResponseWriter, key string) {
+	err := NewStorage().DeleteApp(key)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	removeUsage(key)
+	w.Write(wx.JsonResponse(nil))
+}
+
+// body: {"expires": seconds}, 0 means permanent
+func (srv *AdminServer) renew(w http.ResponseWriter, r *http.Request, key string) {
+	form, err := readAppForm(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(wx.JsonResponse(err))
+		return
+	}
+	if form.Expires == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write(wx.NewErrorStr("expires is required").Serialize())
+		return
+	}
+	app, err := NewStorage().LoadApp(key)
+	if err != nil && err != ErrExpired {
+		writeStorageError(w, err)
+		return
+	}
+	app.renew(*form.Expires)
+	err = NewStorage().SaveApp(app)
+	if err != nil {
+		w.Write(wx.JsonResponse(err))
+		return
+	}
+	w.Write(wx.JsonResponse(newAppView(app)))
+}
+
+func (srv *AdminServer) usage(w http.ResponseWriter, key string) {
+	if _, err := NewStorage().LoadApp(key); err == ErrNotFound {
+		writeStorageError(w, err)
+		return
+	}
+	w.Write(wx.JsonResponse(loadUsage(key)))
+}
+
+func readAppForm(r *http.Request) (form *appForm, err error) {
+	defer r.Body.Close()
+	form = new(appForm)
+	err = json.NewDecoder(r.Body).Decode(form)
+	if err != nil {
+		err = errors.New("invalid json body: " + err.Error())
+	}
+	return
+}
+
+func newAppView(app *WxApp) *appView {
+	r := *app
+	r.mask()
+	return &appView{WxApp: &r, Expired: r.isExpired()}
+}
+
+// expires in seconds from now, 0 means permanent
+func (app *WxApp) renew(seconds int64) {
+	app.Expires = nil
+	if seconds > 0 {
+		tm := time.Now().Add(time.Duration(seconds) * time.Second)
+		app.Expires = &tm
+	}
+}
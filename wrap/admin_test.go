@@ -0,0 +1,152 @@
+package wrap
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+	wx "wechat-proxy/wechat"
+)
+
+func adminRequest(srv *AdminServer, method, url, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, url, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer admin-token")
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+	return w
+}
+
+func TestAdminApps(t *testing.T) {
+	srv := NewAdminServer()
+	srv.AdminToken = "admin-token"
+
+	// expired app is kept when others are saved
+	expired := time.Now().Add(-time.Minute)
+	for _, app := range []*WxApp{
+		{Key: "admin2", AppId: "wx2", Secret: "s2", Owner: "t1", Expires: &expired},
+		{Key: "admin1", AppId: "wx1", Secret: "s1", Owner: "t1"},
+		{Key: "admin3", AppId: "wx3", Secret: "s3", Owner: "t2"},
+	} {
+		if err := NewStorage().SaveApp(app); err != nil {
+			t.Fatal(err)
+		}
+		defer NewStorage().DeleteApp(app.Key)
+	}
+
+	// list with pagination
+	w := adminRequest(srv, "GET", "/admin/apps?owner=t1&offset=1&limit=1", "")
+	var list struct {
+		Total int
+		Apps  []appView
+	}
+	json.Unmarshal(w.Body.Bytes(), &list)
+	if list.Total != 2 || len(list.Apps) != 1 || list.Apps[0].Key != "admin2" || !list.Apps[0].Expired {
+		t.Fatal(w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), "s2") {
+		t.Fatal("secret is not masked", w.Body.String())
+	}
+
+	// renew expired app
+	w = adminRequest(srv, "POST", "/admin/apps/admin2/renew", `{"expires":0}`)
+	if w.Code != http.StatusOK {
+		t.Fatal(w.Body.String())
+	}
+	if app, err := NewStorage().LoadApp("admin2"); err != nil || app.Expires != nil {
+		t.Fatal(app, err)
+	}
+
+	// patch without appid or secret
+	w = adminRequest(srv, "PATCH", "/admin/apps/admin1", `{"calls":["/api","/msg"],"expires":3600}`)
+	if w.Code != http.StatusOK {
+		t.Fatal(w.Body.String())
+	}
+	app, err := NewStorage().LoadApp("admin1")
+	if err != nil || app.Calls != "/api|/msg" || app.Secret != "s1" || app.Expires == nil {
+		t.Fatal(app, err)
+	}
+
+	// usage
+	recordUsage("admin3", "/api/new", usageOk)
+	recordUsage("admin3", "/api", usageDenied)
+	w = adminRequest(srv, "GET", "/admin/apps/admin3/usage", "")
+	var usage appUsage
+	json.Unmarshal(w.Body.Bytes(), &usage)
+	if usage.Calls != 1 || usage.Denied != 1 || usage.Paths["/api"] != 2 {
+		t.Fatal(w.Body.String())
+	}
+
+	// delete
+	w = adminRequest(srv, "DELETE", "/admin/apps/admin3", "")
+	if w.Code != http.StatusOK {
+		t.Fatal(w.Body.String())
+	}
+	w = adminRequest(srv, "GET", "/admin/apps/admin3", "")
+	if w.Code != http.StatusNotFound {
+		t.Fatal(w.Code, w.Body.String())
+	}
+}
+
+func TestAdminReject(t *testing.T) {
+	srv := NewAdminServer()
+	srv.AdminToken = "admin-token"
+
+	r := httptest.NewRequest("GET", "/admin/apps", nil)
+	r.Header.Set("Authorization", "Bearer wrong")
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatal(w.Code)
+	}
+
+	ts_data := []struct {
+		Method string
+		Url    string
+		Body   string
+		Status int
+	}{
+		{"POST", "/admin/apps?secret=s1", `{}`, http.StatusBadRequest},
+		{"POST", "/admin/apps", `{"key":"new"}`, http.StatusBadRequest},
+		{"POST", "/admin/apps", `not json`, http.StatusBadRequest},
+		{"PATCH", "/admin/apps/missing", `{}`, http.StatusNotFound},
+		{"PUT", "/admin/apps/missing", `{}`, http.StatusMethodNotAllowed},
+	}
+	for _, v := range ts_data {
+		w := adminRequest(srv, v.Method, v.Url, v.Body)
+		if w.Code != v.Status {
+			t.Fatal(v, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestAdminStatus(t *testing.T) {
+	srv := NewAdminServer()
+	srv.AdminToken = "admin-token"
+	srv.ApiServer = wx.NewApiServer()
+	srv.MsgServer = wx.NewMessageServer()
+	srv.PayServer = wx.NewPayServer()
+	NewStorage().SaveUser(&WxUser{AppId: "wx-admin", OpenId: "o1", Subscribe: true})
+
+	for _, url := range []string{"/admin/tokens", "/admin/messages?appid=wx1", "/admin/orders"} {
+		w := adminRequest(srv, "GET", url, "")
+		if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "errcode") {
+			t.Fatal(url, w.Body.String())
+		}
+	}
+	w := adminRequest(srv, "GET", "/admin/users?appid=wx-admin", "")
+	if !strings.Contains(w.Body.String(), `"Total":1`) {
+		t.Fatal(w.Body.String())
+	}
+	w = adminRequest(srv, "POST", "/admin/tokens", "")
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatal(w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	NewConsoleServer().ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "/admin/apps") {
+		t.Fatal(w.Code)
+	}
+}
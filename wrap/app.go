@@ -1,25 +1,55 @@
 package wrap
 
 import (
+	"context"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"strings"
 	wx "wechat-proxy/wechat"
 )
 
+// parameters filled by registered app, not accepted from client
+var appParams = []string{"appid", "secret", "access_token", "token", "aes", "mch_id", "mch_key", "server_ip"}
+
 type WrapAppServer struct {
 	wx.WechatClient
+	Handler http.Handler // routes of proxied apis, default is http.DefaultServeMux
 }
 
 func NewWrapAppServer() *WrapAppServer {
 	srv := new(WrapAppServer)
+	srv.Handler = http.DefaultServeMux
 	return srv
 }
 
+type appContextKey struct{}
+
+// registered app of request forwarded by WrapAppServer, nil for direct requests.
+func requestApp(r *http.Request) *WxApp {
+	app, _ := r.Context().Value(appContextKey{}).(*WxApp)
+	return app
+}
+
+// IsAppRequest reports whether r is forwarded by WrapAppServer with parameters of a registered app.
+func IsAppRequest(r *http.Request) bool {
+	return requestApp(r) != nil
+}
+
+// wrap routes read and change data of registered apps, they are only served under /app/<key>/.
+func requireApp(w http.ResponseWriter, r *http.Request) (app *WxApp, ok bool) {
+	app = requestApp(r)
+	if app == nil {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write(wx.NewErrorStr("use /app/<key>" + r.URL.Path).Serialize())
+		return
+	}
+	ok = true
+	return
+}
+
 func (srv *WrapAppServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	log.Println(r.RequestURI)
+	wx.Debugln(r.RequestURI)
 
 	// parse path
 	req_path := strings.TrimLeft(r.URL.Path, "/")
@@ -28,7 +58,7 @@ func (srv *WrapAppServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		if len(parts) == 2 {
 			app, err := srv.appInfo(parts[1])
 			if err != nil {
-				w.Write(wx.JsonResponse(err))
+				writeStorageError(w, err)
 				return
 			}
 			w.Write(wx.JsonResponse(app))
@@ -43,38 +73,52 @@ func (srv *WrapAppServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	// load app
 	app, err := NewStorage().LoadApp(key)
 	if err != nil {
-		log.Println(err.Error())
-		http.NotFound(w, r)
-		return
-	}
-	if app == nil {
-		http.NotFound(w, r)
+		log.Printf("%s: %s\n", err.Error(), key)
+		writeStorageError(w, err)
 		return
 	}
 
 	// check path in calls
 	if !app.inCalls(path) {
 		log.Printf("not in calls: %s\n", path)
+		recordUsage(key, path, usageDenied)
 		http.NotFound(w, r)
 		return
 	}
 
+	// check signature or ip
+	err = app.verifyRequest(r, path)
+	if err != nil {
+		log.Printf("%s: %s\n", err.Error(), r.RemoteAddr)
+		recordUsage(key, path, usageDenied)
+		w.WriteHeader(http.StatusForbidden)
+		w.Write(wx.JsonResponse(err))
+		return
+	}
+	stripSign(r)
+
 	// generate api url
 	url := srv.realUrl(r, path, app)
-	log.Println(url)
+	wx.Debugln(url)
 
 	// call api
-	err = srv.httpProxy(w, r, url)
+	err = srv.forward(w, r, url, app)
 	if err != nil {
+		recordUsage(key, path, usageError)
 		w.Write(wx.JsonResponse(err))
 		return
 	}
+	recordUsage(key, path, usageOk)
 }
 
 func (srv *WrapAppServer) realUrl(r *http.Request, path string, app *WxApp) string {
 
 	// generate api url
-	query := r.URL.RawQuery
+	q := r.URL.Query()
+	for _, k := range appParams {
+		q.Del(k)
+	}
+	query := q.Encode()
 	if strings.HasPrefix(path, "/msg") {
 		access_token, _ := srv.GetAccessToken(srv.HostUrl(r), app.AppId, app.Secret)
 		query += fmt.Sprintf("&appid=%s&access_token=%s&token=%s&aes=%s", app.AppId, access_token, app.Token, app.AesKey)
@@ -89,38 +133,31 @@ func (srv *WrapAppServer) realUrl(r *http.Request, path string, app *WxApp) stri
 	return _url
 }
 
-func (srv *WrapAppServer) httpProxy(w http.ResponseWriter, r *http.Request, url string) (err error) {
-	log.Println(url)
-
-	defer r.Body.Close()
+// serve api url in process, the app is passed in request context.
+func (srv *WrapAppServer) forward(w http.ResponseWriter, r *http.Request, url string, app *WxApp) (err error) {
 	req, err := http.NewRequest(r.Method, url, r.Body)
 	if err != nil {
 		return
 	}
-	for k, v := range r.Header {
-		req.Header[k] = v
-	}
-	for _, c := range r.Cookies() {
-		req.AddCookie(c)
-	}
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return
-	}
-
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return
-	}
+	req.Header = r.Header.Clone()
+	req.ContentLength = r.ContentLength
+	req.RemoteAddr = r.RemoteAddr
+	req.RequestURI = req.URL.RequestURI()
+	req.TLS = r.TLS
+	req = req.WithContext(context.WithValue(r.Context(), appContextKey{}, app))
+	srv.Handler.ServeHTTP(w, req)
+	return
+}
 
-	for k := range resp.Header {
-		v := resp.Header.Get(k)
-		w.Header().Set(k, v)
+// not found and expired apps are distinguished by status and errcode
+func writeStorageError(w http.ResponseWriter, err error) {
+	switch err {
+	case ErrNotFound:
+		w.WriteHeader(http.StatusNotFound)
+	case ErrExpired:
+		w.WriteHeader(http.StatusGone)
 	}
-	w.Write(body)
-	return
+	w.Write(storageError(err).Serialize())
 }
 
 func (srv *WrapAppServer) appInfo(key string) (app *WxApp, err error) {
@@ -128,6 +165,12 @@ func (srv *WrapAppServer) appInfo(key string) (app *WxApp, err error) {
 	if err != nil {
 		return
 	}
+	app.mask()
+	return
+}
+
+// hide secrets in response
+func (app *WxApp) mask() {
 	mask := "********"
 	if (app.Secret != "") {
 		app.Secret = mask
@@ -144,5 +187,7 @@ func (srv *WrapAppServer) appInfo(key string) (app *WxApp, err error) {
 	if (app.MchKey != "") {
 		app.MchKey = mask
 	}
-	return
-}
\ No newline at end of file
+	if (app.ClientSecret != "") {
+		app.ClientSecret = mask
+	}
+}
@@ -0,0 +1,95 @@
+package wrap
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWrapAppErrors(t *testing.T) {
+	expired := time.Now().Add(-time.Minute)
+	if err := NewStorage().SaveApp(&WxApp{Key: "expired", AppId: "wx1", Expires: &expired}); err != nil {
+		t.Fatal(err)
+	}
+	defer NewStorage().DeleteApp("expired")
+
+	srv := NewWrapAppServer()
+	for _, v := range []struct {
+		Url    string
+		Status int
+		Code   int
+	}{
+		{"/app/missing", http.StatusNotFound, ErrCodeNotFound},
+		{"/app/missing/api", http.StatusNotFound, ErrCodeNotFound},
+		{"/app/expired", http.StatusGone, ErrCodeExpired},
+		{"/app/expired/api", http.StatusGone, ErrCodeExpired},
+	} {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", v.Url, nil))
+		var e struct {
+			ErrCode int `json:"errcode"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &e)
+		if w.Code != v.Status || e.ErrCode != v.Code {
+			t.Fatal(v.Url, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestWrapAppForward(t *testing.T) {
+	if err := NewStorage().SaveApp(&WxApp{Key: "fwd", AppId: "wx-fwd", Secret: "s", AllowIps: "192.0.2.1"}); err != nil {
+		t.Fatal(err)
+	}
+	defer NewStorage().DeleteApp("fwd")
+	NewStorage().SaveUser(&WxUser{AppId: "wx-fwd", OpenId: "o1", Subscribe: true})
+	NewStorage().SaveUser(&WxUser{AppId: "wx-fwd-other", OpenId: "o2", Subscribe: true})
+
+	mux := http.NewServeMux()
+	mux.Handle("/user", NewUserServer())
+	srv := NewWrapAppServer()
+	srv.Handler = mux
+
+	// appid of client is replaced by the registered one
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/app/fwd/user?appid=wx-fwd-other", nil))
+	var result struct {
+		Total int
+		Users []*WxUser
+	}
+	json.Unmarshal(w.Body.Bytes(), &result)
+	if result.Total != 1 || result.Users[0].OpenId != "o1" {
+		t.Fatal(w.Body.String())
+	}
+
+	// not served without app
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/user?appid=wx-fwd", nil))
+	if w.Code != http.StatusForbidden {
+		t.Fatal(w.Code, w.Body.String())
+	}
+}
+
+func TestRequireApp(t *testing.T) {
+	ts_data := []struct {
+		Handler http.Handler
+		Url     string
+	}{
+		{NewBroadcastServer(), "/broadcast?appid=wx1&secret=s"},
+		{NewTemplateServer(), "/template/status?appid=wx1&msgid=1"},
+		{NewMenuServer(), "/menu?appid=wx1&secret=s"},
+		{NewTagServer(), "/tags?appid=wx1&secret=s"},
+		{NewSceneServer(), "/qrcode/scenes?appid=wx1"},
+		{NewSyncServer(), "/user/sync?appid=wx1&secret=s"},
+		{NewUserServer(), "/user?appid=wx1"},
+		{NewWebhookServer(), "/user/webhook?appid=wx1"},
+	}
+	for _, v := range ts_data {
+		w := httptest.NewRecorder()
+		v.Handler.ServeHTTP(w, httptest.NewRequest("POST", v.Url, nil))
+		if w.Code != http.StatusForbidden {
+			t.Fatal(v.Url, w.Code, w.Body.String())
+		}
+	}
+}
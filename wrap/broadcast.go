@@ -0,0 +1,426 @@
+package wrap
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	wx "wechat-proxy/wechat"
+)
+
+const (
+	// max count of waiting broadcast jobs
+	broadcastQueueSize = 100
+
+	// max count of openid in one mass/send request
+	broadcastBatchSize = 10000
+)
+
+// doc: https://mp.weixin.qq.com/wiki?t=resource/res_main&id=mp1481187827_i0l21
+type WechatBroadcastServer struct {
+	wx.WechatClient
+	queue chan *broadcastTask
+	lock  sync.Mutex // job and batches are updated by sender and MASSSENDJOBFINISH events
+
+	queueLock sync.RWMutex // queue is closed by Close
+	closed    bool
+	done      chan bool // closed when the sender exits
+}
+
+var (
+	errQueueFull    = errors.New("queue full")
+	errServerClosed = errors.New("server closed")
+)
+
+type broadcastTask struct {
+	job     *WxBroadcast
+	hostUrl string
+	secret  string
+	content map[string]interface{}
+	filter  map[string]interface{}
+	openids []string
+}
+
+func NewBroadcastServer() *WechatBroadcastServer {
+	srv := &WechatBroadcastServer{}
+	srv.queue = make(chan *broadcastTask, broadcastQueueSize)
+	srv.done = make(chan bool)
+	go srv.run()
+	return srv
+}
+
+// Close stops accepting jobs and waits for queued jobs to be sent,
+// it returns false if they are not finished in timeout.
+func (srv *WechatBroadcastServer) Close(timeout time.Duration) bool {
+	srv.queueLock.Lock()
+	if !srv.closed {
+		srv.closed = true
+		close(srv.queue)
+	}
+	srv.queueLock.Unlock()
+
+	select {
+	case <-srv.done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// queue the task without waiting
+func (srv *WechatBroadcastServer) enqueue(t *broadcastTask) (err error) {
+	srv.queueLock.RLock()
+	defer srv.queueLock.RUnlock()
+	if srv.closed {
+		return errServerClosed
+	}
+	select {
+	case srv.queue <- t:
+	default:
+		err = errQueueFull
+	}
+	return
+}
+
+// /broadcast?appid=...&secret=...   (POST json)
+// /broadcast/status?appid=...&id=...
+func (srv *WechatBroadcastServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	wx.Debugln(r.RequestURI)
+	if _, ok := requireApp(w, r); !ok {
+		return
+	}
+	r.ParseForm()
+
+	if strings.HasSuffix(r.URL.Path, "/status") {
+		srv.status(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.NotFound(w, r)
+		return
+	}
+
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.Write(wx.JsonResponse(err))
+		return
+	}
+	t, err := srv.parseTask(r, body)
+	if err != nil {
+		w.Write(wx.JsonResponse(err))
+		return
+	}
+
+	err = NewStorage().SaveBroadcast(t.job)
+	if err != nil {
+		w.Write(wx.JsonResponse(err))
+		return
+	}
+	if err = srv.enqueue(t); err != nil {
+		t.job.Status = "failed"
+		t.job.ErrMsg = err.Error()
+		NewStorage().SaveBroadcast(t.job)
+	}
+	w.Write(wx.JsonResponse(t.job))
+}
+
+// message content is the same as wechat mass api, target is one of:
+// "touser": [openid, ...], "filter": {"is_to_all": bool, "tag_id": int}, "tag_id": int, "is_to_all": bool
+func (srv *WechatBroadcastServer) parseTask(r *http.Request, body []byte) (t *broadcastTask, err error) {
+	var m map[string]interface{}
+	err = json.Unmarshal(body, &m)
+	if err != nil {
+		return
+	}
+	msgtype, _ := m["msgtype"].(string)
+	if msgtype == "" {
+		err = errors.New("msgtype required")
+		return
+	}
+
+	t = &broadcastTask{
+		hostUrl: srv.HostUrl(r),
+		secret:  r.Form.Get("secret"),
+		content: m,
+	}
+
+	// parse target
+	target := "all"
+	if users, ok := m["touser"].([]interface{}); ok {
+		for _, v := range users {
+			if openid, ok := v.(string); ok && openid != "" {
+				t.openids = append(t.openids, openid)
+			}
+		}
+		// mass/send requires at least 2 openids
+		if len(t.openids) < 2 {
+			err = errors.New("touser requires at least 2 openids")
+			return
+		}
+		target = "openid"
+	} else {
+		t.filter, _ = m["filter"].(map[string]interface{})
+		if t.filter == nil {
+			t.filter = map[string]interface{}{"is_to_all": true}
+		}
+		if v, ok := m["is_to_all"]; ok {
+			t.filter["is_to_all"] = v
+		}
+		if v, ok := m["tag_id"]; ok {
+			t.filter["is_to_all"] = false
+			t.filter["tag_id"] = v
+		}
+		if all, _ := t.filter["is_to_all"].(bool); !all {
+			target = fmt.Sprintf("tag:%v", t.filter["tag_id"])
+		}
+	}
+	for _, k := range []string{"touser", "filter", "tag_id", "is_to_all"} {
+		delete(m, k)
+	}
+
+	content, err := json.Marshal(m)
+	if err != nil {
+		return
+	}
+	t.job = &WxBroadcast{
+		AppId:      r.Form.Get("appid"),
+		JobId:      fmt.Sprintf("%s-%06d", time.Now().Format("20060102150405"), rand.Intn(1000000)),
+		MsgType:    msgtype,
+		Content:    string(content),
+		Target:     target,
+		Status:     "queued",
+		CreateTime: uint64(time.Now().Unix()),
+	}
+	return
+}
+
+func (srv *WechatBroadcastServer) run() {
+	defer close(srv.done)
+	for t := range srv.queue {
+		srv.sendJob(t)
+	}
+}
+
+func (srv *WechatBroadcastServer) sendJob(t *broadcastTask) {
+	job := t.job
+	log.Printf("broadcast: %s %s\n", job.JobId, job.Target)
+
+	access_token, wxErr := srv.GetAccessToken(t.hostUrl, job.AppId, t.secret)
+	if wxErr != nil {
+		srv.saveResult(job, 0, wxErr.ErrMsg)
+		return
+	}
+
+	var errs []string
+	var batches []map[string]interface{}
+	if len(t.openids) > 0 {
+		for i, end := 0, 0; i < len(t.openids); i = end {
+			end = i + broadcastBatchSize
+			if end > len(t.openids) {
+				end = len(t.openids)
+			} else if len(t.openids)-end == 1 {
+				// leave 2 openids to the last batch, mass/send requires at least 2
+				end--
+			}
+			batches = append(batches, map[string]interface{}{"touser": t.openids[i:end]})
+		}
+	} else {
+		batches = append(batches, map[string]interface{}{"filter": t.filter})
+	}
+
+	count := 0
+	for _, target := range batches {
+		msgid, err := srv.sendBatch(access_token, t.content, target)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		srv.saveBatch(job, msgid)
+		count++
+	}
+	srv.saveResult(job, count, strings.Join(errs, "; "))
+}
+
+// the finish event may arrive before the batch is saved, its result is kept then.
+func (srv *WechatBroadcastServer) saveBatch(job *WxBroadcast, msgid uint64) {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+
+	b, err := NewStorage().LoadBroadcastBatch(job.AppId, msgid)
+	if err != nil {
+		b = &WxBroadcastBatch{AppId: job.AppId, MsgId: msgid, Status: "sending"}
+	}
+	b.JobId = job.JobId
+	err = NewStorage().SaveBroadcastBatch(b)
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+func (srv *WechatBroadcastServer) saveResult(job *WxBroadcast, batches int, errMsg string) {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+
+	now := uint64(time.Now().Unix())
+	job.Batches = batches
+	job.ErrMsg = errMsg
+	job.Status = "sent"
+	if batches == 0 {
+		job.Status = "failed"
+		job.FinishTime = now
+	} else {
+		srv.summarize(job, now)
+	}
+	err := NewStorage().SaveBroadcast(job)
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+// sum results of batches, a sent job is finished when all its batches are finished.
+// must be called with lock held.
+func (srv *WechatBroadcastServer) summarize(job *WxBroadcast, finishTime uint64) {
+	batches, err := NewStorage().LoadBroadcastBatches(job.AppId, job.JobId)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	job.TotalCount, job.FilterCount, job.SentCount, job.ErrorCount = 0, 0, 0, 0
+	finished := job.Status == "sent" && len(batches) >= job.Batches
+	for _, v := range batches {
+		job.TotalCount += v.TotalCount
+		job.FilterCount += v.FilterCount
+		job.SentCount += v.SentCount
+		job.ErrorCount += v.ErrorCount
+		if v.Status == "sending" {
+			finished = false
+		}
+	}
+	if finished {
+		job.Status = "finished"
+		job.FinishTime = finishTime
+	}
+}
+
+func (srv *WechatBroadcastServer) sendBatch(access_token string, content, target map[string]interface{}) (msgid uint64, err error) {
+	m := make(map[string]interface{})
+	for k, v := range content {
+		m[k] = v
+	}
+	for k, v := range target {
+		m[k] = v
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return
+	}
+
+	api := "sendall"
+	if _, ok := target["touser"]; ok {
+		api = "send"
+	}
+	_url := fmt.Sprintf(wx.ApiBaseUrl+"/cgi-bin/message/mass/%s?access_token=%s", api, access_token)
+	resp, err := http.Post(_url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+
+	result := &struct {
+		wx.WxError
+		MsgId uint64 `json:"msg_id"`
+	}{}
+	err = json.Unmarshal(body, result)
+	if err != nil {
+		return
+	}
+	if !result.Success() {
+		err = errors.New(result.String())
+		return
+	}
+	msgid = result.MsgId
+	return
+}
+
+func (srv *WechatBroadcastServer) status(w http.ResponseWriter, r *http.Request) {
+	appid, jobid := r.Form.Get("appid"), r.Form.Get("id")
+	job, err := NewStorage().LoadBroadcast(appid, jobid)
+	if err != nil {
+		w.Write(wx.JsonResponse(err))
+		return
+	}
+	batches, err := NewStorage().LoadBroadcastBatches(appid, jobid)
+	if err != nil {
+		w.Write(wx.JsonResponse(err))
+		return
+	}
+	w.Write(wx.JsonResponse(&struct {
+		*WxBroadcast
+		Results []*WxBroadcastBatch
+	}{job, batches}))
+}
+
+// JobFinish handles MASSSENDJOBFINISH event from WechatMessageServer.
+func (srv *WechatBroadcastServer) JobFinish(appid string, msg []byte) {
+	var e struct {
+		CreateTime  uint64
+		MsgID       uint64
+		Status      string
+		TotalCount  int
+		FilterCount int
+		SentCount   int
+		ErrorCount  int
+	}
+	err := xml.Unmarshal(msg, &e)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	log.Printf("broadcast job finish: %#v\n", e)
+
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+
+	// job id is unknown if the batch is not saved yet, the job is summarized when it is sent
+	b, err := NewStorage().LoadBroadcastBatch(appid, e.MsgID)
+	if err != nil {
+		b = &WxBroadcastBatch{AppId: appid, MsgId: e.MsgID}
+	}
+	b.Status = e.Status
+	b.TotalCount = e.TotalCount
+	b.FilterCount = e.FilterCount
+	b.SentCount = e.SentCount
+	b.ErrorCount = e.ErrorCount
+	err = NewStorage().SaveBroadcastBatch(b)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	if b.JobId == "" {
+		return
+	}
+
+	job, err := NewStorage().LoadBroadcast(appid, b.JobId)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	srv.summarize(job, e.CreateTime)
+	err = NewStorage().SaveBroadcast(job)
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
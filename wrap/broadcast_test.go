@@ -0,0 +1,200 @@
+package wrap
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func broadcastFinishEvent(msgid uint64, sent int) []byte {
+	return []byte(fmt.Sprintf(`<xml>
+<CreateTime>1394524295</CreateTime>
+<MsgType><![CDATA[event]]></MsgType>
+<Event><![CDATA[MASSSENDJOBFINISH]]></Event>
+<MsgID>%d</MsgID>
+<Status><![CDATA[send success]]></Status>
+<TotalCount>%d</TotalCount>
+<FilterCount>%d</FilterCount>
+<SentCount>%d</SentCount>
+<ErrorCount>0</ErrorCount>
+</xml>`, msgid, sent, sent, sent))
+}
+
+func TestBroadcastParseTask(t *testing.T) {
+	ts_data := []struct {
+		Body   string
+		Target string
+		Filter string
+		Valid  bool
+	}{
+		{`{"msgtype":"text","text":{"content":"hi"}}`, "all", `{"is_to_all":true}`, true},
+		{`{"msgtype":"text","text":{"content":"hi"},"tag_id":2}`, "tag:2", `{"is_to_all":false,"tag_id":2}`, true},
+		{`{"msgtype":"text","filter":{"is_to_all":false,"tag_id":3}}`, "tag:3", `{"is_to_all":false,"tag_id":3}`, true},
+		{`{"msgtype":"text","touser":["o1","o2"]}`, "openid", `null`, true},
+		{`{"msgtype":"text","touser":[]}`, "", "", false},
+		{`{"msgtype":"text","touser":["o1"]}`, "", "", false},
+		{`{"msgtype":"text","touser":["o1",""]}`, "", "", false},
+		{`{"text":{"content":"hi"}}`, "", "", false},
+	}
+
+	srv := &WechatBroadcastServer{}
+	for _, v := range ts_data {
+		r := httptest.NewRequest("POST", "/broadcast?appid=wx-bc&secret=s", nil)
+		r.ParseForm()
+		task, err := srv.parseTask(r, []byte(v.Body))
+		if (err == nil) != v.Valid {
+			t.Fatal(v.Body, err)
+		}
+		if err != nil {
+			continue
+		}
+		filter, _ := json.Marshal(task.filter)
+		if task.job.Target != v.Target || string(filter) != v.Filter || task.job.Status != "queued" {
+			t.Fatal(v.Body, task.job.Target, string(filter))
+		}
+		if strings.Contains(task.job.Content, "touser") || strings.Contains(task.job.Content, "filter") {
+			t.Fatal("target is kept in content", task.job.Content)
+		}
+	}
+}
+
+func TestBroadcastSend(t *testing.T) {
+	// batches are finished by event before the sender saves them
+	srv := &WechatBroadcastServer{queue: make(chan *broadcastTask, 1)}
+	var lock sync.Mutex
+	var sizes []int
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cgi-bin/message/mass/send", func(w http.ResponseWriter, r *http.Request) {
+		var m struct{ ToUser []string }
+		body, _ := ioutil.ReadAll(r.Body)
+		json.Unmarshal(body, &m)
+
+		lock.Lock()
+		sizes = append(sizes, len(m.ToUser))
+		msgid := uint64(1000 + len(sizes))
+		lock.Unlock()
+
+		srv.JobFinish("wx-bc", broadcastFinishEvent(msgid, len(m.ToUser)))
+		fmt.Fprintf(w, `{"errcode":0,"errmsg":"send job submission success","msg_id":%d}`, msgid)
+	})
+	mux.Handle("/broadcast", asApp(srv, &WxApp{Key: "bc", AppId: "wx-bc"}))
+	mux.Handle("/broadcast/status", asApp(srv, &WxApp{Key: "bc", AppId: "wx-bc"}))
+	ts := newWechatMock(t, mux)
+
+	openids := make([]string, broadcastBatchSize+1)
+	for i := range openids {
+		openids[i] = fmt.Sprintf("o%d", i)
+	}
+	body, _ := json.Marshal(map[string]interface{}{"msgtype": "text", "text": map[string]string{"content": "hi"}, "touser": openids})
+	resp, err := http.Post(ts.URL+"/broadcast?appid=wx-bc&secret=s", "application/json", strings.NewReader(string(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := &WxBroadcast{}
+	json.NewDecoder(resp.Body).Decode(job)
+	resp.Body.Close()
+	if job.Status != "queued" {
+		t.Fatal(job)
+	}
+
+	// queue is full
+	resp, err = http.Post(ts.URL+"/broadcast?appid=wx-bc&secret=s", "application/json", strings.NewReader(`{"msgtype":"text"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	full := &WxBroadcast{}
+	json.NewDecoder(resp.Body).Decode(full)
+	resp.Body.Close()
+	if full.Status != "failed" || full.ErrMsg != "queue full" {
+		t.Fatal(full)
+	}
+
+	srv.sendJob(<-srv.queue)
+	// the last batch is not a single openid
+	if len(sizes) != 2 || sizes[0] != broadcastBatchSize-1 || sizes[1] != 2 {
+		t.Fatal(sizes)
+	}
+
+	resp, err = http.Get(ts.URL + "/broadcast/status?appid=wx-bc&id=" + job.JobId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var status struct {
+		WxBroadcast
+		Results []*WxBroadcastBatch
+	}
+	json.NewDecoder(resp.Body).Decode(&status)
+	if status.Status != "finished" || status.Batches != 2 || status.SentCount != len(openids) || len(status.Results) != 2 {
+		t.Fatal(status)
+	}
+}
+
+func TestBroadcastFinishAfterSent(t *testing.T) {
+	srv := &WechatBroadcastServer{}
+	job := &WxBroadcast{AppId: "wx-bc", JobId: "job-after", Status: "queued"}
+	NewStorage().SaveBroadcast(job)
+	srv.saveBatch(job, 2001)
+	srv.saveBatch(job, 2002)
+	srv.saveResult(job, 2, "")
+
+	srv.JobFinish("wx-bc", broadcastFinishEvent(2001, 5))
+	job, _ = NewStorage().LoadBroadcast("wx-bc", "job-after")
+	if job.Status != "sent" || job.SentCount != 5 {
+		t.Fatal(job)
+	}
+	srv.JobFinish("wx-bc", broadcastFinishEvent(2002, 3))
+	job, _ = NewStorage().LoadBroadcast("wx-bc", "job-after")
+	if job.Status != "finished" || job.SentCount != 8 || job.FinishTime != 1394524295 {
+		t.Fatal(job)
+	}
+}
+
+func TestBroadcastClose(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cgi-bin/message/mass/sendall", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte(`{"errcode":0,"errmsg":"send job submission success","msg_id":2001}`))
+	})
+	ts := newWechatMock(t, mux)
+
+	// queued jobs are sent before Close returns
+	srv := NewBroadcastServer()
+	var jobs []*WxBroadcast
+	for i := 0; i < 3; i++ {
+		r := httptest.NewRequest("POST", "/broadcast?appid=wx-close&secret=s", nil)
+		r.ParseForm()
+		task, err := srv.parseTask(r, []byte(`{"msgtype":"text","text":{"content":"hi"}}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		task.hostUrl = ts.URL
+		NewStorage().SaveBroadcast(task.job)
+		if err := srv.enqueue(task); err != nil {
+			t.Fatal(err)
+		}
+		jobs = append(jobs, task.job)
+	}
+	if !srv.Close(5 * time.Second) {
+		t.Fatal("queue is not drained")
+	}
+	for _, job := range jobs {
+		if job, _ := NewStorage().LoadBroadcast("wx-close", job.JobId); job.Status != "sent" {
+			t.Fatal(job)
+		}
+	}
+
+	// closed server rejects jobs, and can be closed again
+	if err := srv.enqueue(&broadcastTask{}); err != errServerClosed {
+		t.Fatal(err)
+	}
+	if !srv.Close(time.Second) {
+		t.Fatal("closed twice")
+	}
+}
@@ -0,0 +1,19 @@
+package wrap
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed console
+var consoleFiles embed.FS
+
+// static pages of admin console, data is loaded from /admin api with the admin token entered in browser.
+func NewConsoleServer() http.Handler {
+	files, err := fs.Sub(consoleFiles, "console")
+	if err != nil {
+		panic(err)
+	}
+	return http.FileServer(http.FS(files))
+}
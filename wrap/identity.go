@@ -0,0 +1,156 @@
+package wrap
+
+import (
+	"errors"
+	"net/http"
+	wx "wechat-proxy/wechat"
+)
+
+var ErrNoUnionId = errors.New("user has no unionid")
+
+// the same person in several apps, linked by unionid
+type userIdentity struct {
+	UnionId string
+	Users   []*WxUser
+}
+
+// /user/identity?appid=...&openid=...
+// /user/identity?unionid=...
+// only users of apps with the same owner as the requesting app are returned.
+func (srv *WechatUserServer) identity(w http.ResponseWriter, r *http.Request) {
+	f := r.Form
+	appids, err := ownerAppIds(requestApp(r).Owner)
+	if err != nil {
+		w.Write(wx.JsonResponse(err))
+		return
+	}
+	unionid := f.Get("unionid")
+	if unionid == "" {
+		unionid, err = loadUnionId(f.Get("appid"), f.Get("openid"))
+		if err != nil {
+			w.Write(wx.JsonResponse(err))
+			return
+		}
+	}
+
+	users, err := NewStorage().LoadUnionUsers(unionid)
+	if err != nil {
+		w.Write(wx.JsonResponse(err))
+		return
+	}
+	owned := make([]*WxUser, 0, len(users))
+	for _, u := range users {
+		if appids[u.AppId] {
+			owned = append(owned, u)
+		}
+	}
+	if len(owned) == 0 {
+		w.Write(wx.JsonResponse(ErrNotFound))
+		return
+	}
+	w.Write(wx.JsonResponse(&userIdentity{unionid, owned}))
+}
+
+// /user/resolve?appid=...&openid=...&to=...
+// to is the key or appid of another registered app of the same owner.
+func (srv *WechatUserServer) resolve(w http.ResponseWriter, r *http.Request) {
+	f := r.Form
+	owner := requestApp(r).Owner
+	to := f.Get("to")
+	if app, err := NewStorage().LoadApp(to); err == nil && app.Owner == owner {
+		to = app.AppId
+	}
+	appids, err := ownerAppIds(owner)
+	if err != nil {
+		w.Write(wx.JsonResponse(err))
+		return
+	}
+	if !appids[to] {
+		w.Write(wx.JsonResponse(ErrNotFound))
+		return
+	}
+
+	unionid, err := loadUnionId(f.Get("appid"), f.Get("openid"))
+	if err != nil {
+		w.Write(wx.JsonResponse(err))
+		return
+	}
+	users, err := NewStorage().LoadUnionUsers(unionid)
+	if err != nil {
+		w.Write(wx.JsonResponse(err))
+		return
+	}
+	openid, ok := linkOpenIds(users, "", appids)[to]
+	if !ok {
+		w.Write(wx.JsonResponse(ErrNotFound))
+		return
+	}
+	w.Write(wx.JsonResponse(&struct {
+		AppId   string
+		OpenId  string
+		UnionId string
+	}{to, openid, unionid}))
+}
+
+// LinkOpenIds binds the auth flow started by r to the owner of its app,
+// the returned func gives openids of the unionid in other apps of that owner, keyed by appid.
+// auth flows not started under /app/<key>/auth are not linked.
+func LinkOpenIds(r *http.Request, appid string) func(unionid string) map[string]string {
+	app := requestApp(r)
+	if app == nil {
+		return nil
+	}
+	owner := app.Owner
+	return func(unionid string) map[string]string {
+		if unionid == "" {
+			return nil
+		}
+		appids, err := ownerAppIds(owner)
+		if err != nil {
+			return nil
+		}
+		users, err := NewStorage().LoadUnionUsers(unionid)
+		if err != nil {
+			return nil
+		}
+		return linkOpenIds(users, appid, appids)
+	}
+}
+
+func linkOpenIds(users []*WxUser, exclude string, appids map[string]bool) map[string]string {
+	links := make(map[string]string)
+	for _, u := range users {
+		if u.AppId != exclude && appids[u.AppId] {
+			links[u.AppId] = u.OpenId
+		}
+	}
+	return links
+}
+
+// appids of registered apps of the owner, empty owner means apps registered by admin.
+func ownerAppIds(owner string) (appids map[string]bool, err error) {
+	apps, err := NewStorage().LoadApps()
+	if err != nil {
+		return
+	}
+	appids = make(map[string]bool)
+	for _, app := range apps {
+		if app.Owner == owner {
+			appids[app.AppId] = true
+		}
+	}
+	return
+}
+
+func loadUnionId(appid, openid string) (unionid string, err error) {
+	u, err := NewStorage().LoadUser(appid, openid)
+	if err != nil {
+		return
+	}
+	if u.UnionId == "" {
+		err = ErrNoUnionId
+		return
+	}
+	unionid = u.UnionId
+	return
+}
@@ -0,0 +1,102 @@
+package wrap
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestLinkOpenIds(t *testing.T) {
+	users := []*WxUser{
+		{AppId: "wx1", OpenId: "o1", UnionId: "u1"},
+		{AppId: "wx2", OpenId: "o2", UnionId: "u1"},
+		{AppId: "wx3", OpenId: "o3", UnionId: "u1"},
+	}
+	all := map[string]bool{"wx1": true, "wx2": true, "wx3": true}
+	links := linkOpenIds(users, "wx1", all)
+	if len(links) != 2 || links["wx2"] != "o2" || links["wx3"] != "o3" {
+		t.Fatal(links)
+	}
+	links = linkOpenIds(users, "", all)
+	if len(links) != 3 || links["wx1"] != "o1" {
+		t.Fatal(links)
+	}
+	links = linkOpenIds(users, "wx1", map[string]bool{"wx1": true, "wx2": true})
+	if len(links) != 1 || links["wx2"] != "o2" {
+		t.Fatal(links)
+	}
+}
+
+func TestIdentityOwner(t *testing.T) {
+	apps := []*WxApp{
+		{Key: "id1", AppId: "wx-id1", Secret: "s1", Owner: "t-id", Unsigned: true},
+		{Key: "id2", AppId: "wx-id2", Secret: "s2", Owner: "t-id", Unsigned: true},
+		{Key: "id3", AppId: "wx-id3", Secret: "s3", Owner: "t-other", Unsigned: true},
+	}
+	for _, app := range apps {
+		if err := NewStorage().SaveApp(app); err != nil {
+			t.Fatal(err)
+		}
+		defer NewStorage().DeleteApp(app.Key)
+		NewStorage().SaveUser(&WxUser{AppId: app.AppId, OpenId: "o-" + app.Key, UnionId: "u-id", Subscribe: true})
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/user", NewUserServer())
+	mux.Handle("/user/", NewUserServer())
+	srv := NewWrapAppServer()
+	srv.Handler = mux
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	// users of other owners are not returned
+	var identity userIdentity
+	w := get("/app/id1/user/identity?openid=o-id1")
+	json.Unmarshal(w.Body.Bytes(), &identity)
+	if len(identity.Users) != 2 {
+		t.Fatal(w.Body.String())
+	}
+	for _, u := range identity.Users {
+		if u.AppId == "wx-id3" {
+			t.Fatal(w.Body.String())
+		}
+	}
+	w = get("/app/id1/user/identity?unionid=u-id")
+	json.Unmarshal(w.Body.Bytes(), &identity)
+	if len(identity.Users) != 2 {
+		t.Fatal(w.Body.String())
+	}
+
+	// resolve into apps of the same owner only
+	ts_data := []struct {
+		To     string
+		OpenId string
+	}{
+		{"id2", "o-id2"},
+		{"wx-id2", "o-id2"},
+		{"id3", ""},
+		{"wx-id3", ""},
+	}
+	for _, v := range ts_data {
+		var result struct{ OpenId string }
+		w := get("/app/id1/user/resolve?openid=o-id1&to=" + v.To)
+		json.Unmarshal(w.Body.Bytes(), &result)
+		if result.OpenId != v.OpenId {
+			t.Fatal(v.To, w.Body.String())
+		}
+	}
+
+	// auth links
+	r := httptest.NewRequest("GET", "/auth", nil)
+	if LinkOpenIds(r, "wx-id1") != nil {
+		t.Fatal("linked without app")
+	}
+	links := LinkOpenIds(withApp(r, apps[0]), "wx-id1")("u-id")
+	if len(links) != 1 || links["wx-id2"] != "o-id2" {
+		t.Fatal(links)
+	}
+}
@@ -0,0 +1,92 @@
+package wrap
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+	wx "wechat-proxy/wechat"
+)
+
+const (
+	earthRadius = 6371000.0 // meters
+
+	trackDefaultDuration = 7 * 24 * time.Hour
+	nearDefaultRadius    = 1000
+)
+
+// user near a coordinate
+type nearUser struct {
+	*WxUser
+	Distance float64 // meters
+}
+
+// /user/track?appid=...&openid=...&begin=&end=
+func (srv *WechatUserServer) track(w http.ResponseWriter, r *http.Request) {
+	f := r.Form
+	end := parseTime(f.Get("end"), time.Now())
+	begin := parseTime(f.Get("begin"), end.Add(-trackDefaultDuration))
+
+	ls, err := NewStorage().LoadLocations(f.Get("appid"), f.Get("openid"), uint64(begin.Unix()), uint64(end.Unix()))
+	if err != nil {
+		w.Write(wx.JsonResponse(err))
+		return
+	}
+	w.Write(wx.JsonResponse(ls))
+}
+
+// /user/near?appid=...&lat=...&lng=...&radius=&since=
+func (srv *WechatUserServer) near(w http.ResponseWriter, r *http.Request) {
+	f := r.Form
+	lat, err := strconv.ParseFloat(f.Get("lat"), 64)
+	if err != nil {
+		w.Write(wx.JsonResponse(err))
+		return
+	}
+	lng, err := strconv.ParseFloat(f.Get("lng"), 64)
+	if err != nil {
+		w.Write(wx.JsonResponse(err))
+		return
+	}
+	radius, _ := strconv.ParseFloat(f.Get("radius"), 64)
+	if radius <= 0 {
+		radius = nearDefaultRadius
+	}
+	since := uint64(parseTime(f.Get("since"), zeroTime).Unix())
+
+	users, err := NewStorage().LoadUsers(f.Get("appid"))
+	if err != nil {
+		w.Write(wx.JsonResponse(err))
+		return
+	}
+	w.Write(wx.JsonResponse(nearUsers(users, lat, lng, radius, since)))
+}
+
+// users whose latest location is within radius, nearest first
+func nearUsers(users []*WxUser, lat, lng, radius float64, since uint64) []*nearUser {
+	result := []*nearUser{}
+	for _, u := range users {
+		if u.LocationTime == 0 || u.LocationTime < since {
+			continue
+		}
+		d := distance(lat, lng, u.Latitude, u.Longitude)
+		if d <= radius {
+			result = append(result, &nearUser{u, d})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Distance < result[j].Distance
+	})
+	return result
+}
+
+// haversine distance in meters
+func distance(lat1, lng1, lat2, lng2 float64) float64 {
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLng := (lng2 - lng1) * rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
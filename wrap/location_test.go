@@ -0,0 +1,34 @@
+package wrap
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDistance(t *testing.T) {
+	// Tiananmen to Beijing Railway Station, about 2.6km
+	d := distance(39.908823, 116.397470, 39.902892, 116.427080)
+	if math.Abs(d-2600) > 200 {
+		t.Fatal(d)
+	}
+	if distance(30, 120, 30, 120) != 0 {
+		t.Fatal("distance to self")
+	}
+}
+
+func TestNearUsers(t *testing.T) {
+	users := []*WxUser{
+		{OpenId: "o1", Latitude: 39.908823, Longitude: 116.397470, LocationTime: 100},
+		{OpenId: "o2", Latitude: 39.902892, Longitude: 116.427080, LocationTime: 100},
+		{OpenId: "o3", Latitude: 39.9088, Longitude: 116.3975, LocationTime: 10},
+		{OpenId: "o4"},
+	}
+	near := nearUsers(users, 39.9088, 116.3975, 500, 0)
+	if len(near) != 2 || near[0].OpenId != "o3" || near[1].OpenId != "o1" {
+		t.Fatal(near)
+	}
+	near = nearUsers(users, 39.9088, 116.3975, 5000, 50)
+	if len(near) != 2 || near[0].OpenId != "o1" || near[1].OpenId != "o2" {
+		t.Fatal(near)
+	}
+}
@@ -0,0 +1,413 @@
+package wrap
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	wx "wechat-proxy/wechat"
+)
+
+const (
+	menuButtonLimit    = 3  // max count of top level buttons
+	menuSubButtonLimit = 5  // max count of sub buttons
+	menuNameLimit      = 16 // max bytes of top level button name
+	menuSubNameLimit   = 60 // max bytes of sub button name
+	menuKeyLimit       = 128
+	menuUrlLimit       = 1024
+)
+
+// button type and its necessary fields
+var menuButtonTypes = map[string][]string{
+	"click":              {"key"},
+	"view":               {"url"},
+	"scancode_push":      {"key"},
+	"scancode_waitmsg":   {"key"},
+	"pic_sysphoto":       {"key"},
+	"pic_photo_or_album": {"key"},
+	"pic_weixin":         {"key"},
+	"location_select":    {"key"},
+	"media_id":           {"media_id"},
+	"view_limited":       {"media_id"},
+	"miniprogram":        {"url", "appid", "pagepath"},
+}
+
+// doc: https://mp.weixin.qq.com/wiki?t=resource/res_main&id=mp1421141013
+// doc: https://mp.weixin.qq.com/wiki?t=resource/res_main&id=mp1455782296
+type WechatMenuServer struct {
+	wx.WechatClient
+}
+
+func NewMenuServer() *WechatMenuServer {
+	srv := &WechatMenuServer{}
+	return srv
+}
+
+// /menu?appid=...&secret=...           (GET: current menu, POST: publish menu)
+// /menu/delete?appid=...&secret=...&menuid=
+// /menu/versions?appid=...&version=
+// /menu/diff?appid=...&from=...&to=
+// /menu/rollback?appid=...&secret=...&version=...
+func (srv *WechatMenuServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	wx.Debugln(r.RequestURI)
+	if _, ok := requireApp(w, r); !ok {
+		return
+	}
+	r.ParseForm()
+
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/menu"):
+		if r.Method == http.MethodPost {
+			srv.create(w, r)
+		} else {
+			srv.callApi(w, r, "menu/get", nil)
+		}
+	case strings.HasSuffix(r.URL.Path, "/delete"):
+		srv.delete(w, r)
+	case strings.HasSuffix(r.URL.Path, "/versions"):
+		srv.versions(w, r)
+	case strings.HasSuffix(r.URL.Path, "/diff"):
+		srv.diff(w, r)
+	case strings.HasSuffix(r.URL.Path, "/rollback"):
+		srv.rollback(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (srv *WechatMenuServer) create(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.Write(wx.JsonResponse(err))
+		return
+	}
+	menu := &menuDefine{}
+	err = json.Unmarshal(body, menu)
+	if err != nil {
+		w.Write(wx.JsonResponse(err))
+		return
+	}
+	srv.publish(w, r, menu, "create")
+}
+
+// validate, call wechat and store as a new version
+func (srv *WechatMenuServer) publish(w http.ResponseWriter, r *http.Request, menu *menuDefine, action string) {
+	err := menu.validate()
+	if err != nil {
+		w.Write(wx.NewErrorStr(err.Error()).Serialize())
+		return
+	}
+	data, err := json.Marshal(menu)
+	if err != nil {
+		w.Write(wx.JsonResponse(err))
+		return
+	}
+
+	api := "menu/create"
+	if menu.MatchRule != nil {
+		api = "menu/addconditional"
+	}
+	var result struct {
+		wx.WxError
+		MenuId string `json:"menuid"`
+	}
+	body, ok := srv.callApi(w, r, api, data)
+	if !ok {
+		return
+	}
+	json.Unmarshal(body, &result)
+
+	// store version
+	appid := r.Form.Get("appid")
+	m := &WxMenu{
+		AppId:       appid,
+		Version:     srv.lastVersion(appid) + 1,
+		MenuId:      result.MenuId,
+		Conditional: menu.MatchRule != nil,
+		Body:        string(data),
+		Action:      action,
+		CreateTime:  uint64(time.Now().Unix()),
+	}
+	err = NewStorage().SaveMenu(m)
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+func (srv *WechatMenuServer) delete(w http.ResponseWriter, r *http.Request) {
+	menuid := r.Form.Get("menuid")
+	if menuid == "" {
+		srv.callApi(w, r, "menu/delete", nil)
+		return
+	}
+	data := []byte(fmt.Sprintf(`{"menuid":%q}`, menuid))
+	srv.callApi(w, r, "menu/delconditional", data)
+}
+
+func (srv *WechatMenuServer) versions(w http.ResponseWriter, r *http.Request) {
+	appid := r.Form.Get("appid")
+	if v := r.Form.Get("version"); v != "" {
+		version, _ := strconv.Atoi(v)
+		m, err := NewStorage().LoadMenu(appid, version)
+		if err != nil {
+			w.Write(wx.JsonResponse(err))
+			return
+		}
+		w.Write(wx.JsonResponse(m))
+		return
+	}
+	ms, err := NewStorage().LoadMenus(appid)
+	if err != nil {
+		w.Write(wx.JsonResponse(err))
+		return
+	}
+	w.Write(wx.JsonResponse(ms))
+}
+
+func (srv *WechatMenuServer) diff(w http.ResponseWriter, r *http.Request) {
+	appid := r.Form.Get("appid")
+	from, _ := strconv.Atoi(r.Form.Get("from"))
+	to, _ := strconv.Atoi(r.Form.Get("to"))
+	if to == 0 {
+		to = srv.lastVersion(appid)
+	}
+	if from == 0 {
+		from = to - 1
+	}
+
+	m1, err := NewStorage().LoadMenu(appid, from)
+	if err != nil {
+		w.Write(wx.JsonResponse(err))
+		return
+	}
+	m2, err := NewStorage().LoadMenu(appid, to)
+	if err != nil {
+		w.Write(wx.JsonResponse(err))
+		return
+	}
+	changes, err := menuDiff(m1.Body, m2.Body)
+	if err != nil {
+		w.Write(wx.JsonResponse(err))
+		return
+	}
+	w.Write(wx.JsonResponse(changes))
+}
+
+func (srv *WechatMenuServer) rollback(w http.ResponseWriter, r *http.Request) {
+	appid := r.Form.Get("appid")
+	version, _ := strconv.Atoi(r.Form.Get("version"))
+	m, err := NewStorage().LoadMenu(appid, version)
+	if err != nil {
+		w.Write(wx.JsonResponse(err))
+		return
+	}
+	menu := &menuDefine{}
+	err = json.Unmarshal([]byte(m.Body), menu)
+	if err != nil {
+		w.Write(wx.JsonResponse(err))
+		return
+	}
+	srv.publish(w, r, menu, fmt.Sprintf("rollback:%d", version))
+}
+
+func (srv *WechatMenuServer) lastVersion(appid string) (version int) {
+	ms, err := NewStorage().LoadMenus(appid)
+	if err != nil {
+		return
+	}
+	for _, m := range ms {
+		if m.Version > version {
+			version = m.Version
+		}
+	}
+	return
+}
+
+// call wechat menu api and write the response, ok is false if wechat returns error.
+func (srv *WechatMenuServer) callApi(w http.ResponseWriter, r *http.Request, api string, data []byte) (body []byte, ok bool) {
+	f := r.Form
+	access_token, wxErr := srv.GetAccessToken(srv.HostUrl(r), f.Get("appid"), f.Get("secret"))
+	if wxErr != nil {
+		w.Write(wxErr.Serialize())
+		return
+	}
+
+	_url := fmt.Sprintf(wx.ApiBaseUrl+"/cgi-bin/%s?access_token=%s", api, access_token)
+	var err error
+	if data == nil {
+		body, err = wx.HttpGetJson(_url, nil)
+	} else {
+		var resp *http.Response
+		resp, err = http.Post(_url, "application/json", bytes.NewReader(data))
+		if err == nil {
+			defer resp.Body.Close()
+			body, err = ioutil.ReadAll(resp.Body)
+		}
+	}
+	if err != nil {
+		w.Write(wx.JsonResponse(err))
+		return
+	}
+	w.Write(body)
+
+	var e wx.WxError
+	json.Unmarshal(body, &e)
+	ok = e.Success()
+	return
+}
+
+type menuDefine struct {
+	Button    []menuButton   `json:"button"`
+	MatchRule *menuMatchRule `json:"matchrule,omitempty"`
+}
+
+type menuButton struct {
+	Type      string       `json:"type,omitempty"`
+	Name      string       `json:"name"`
+	Key       string       `json:"key,omitempty"`
+	Url       string       `json:"url,omitempty"`
+	MediaId   string       `json:"media_id,omitempty"`
+	AppId     string       `json:"appid,omitempty"`
+	PagePath  string       `json:"pagepath,omitempty"`
+	SubButton []menuButton `json:"sub_button,omitempty"`
+}
+
+type menuMatchRule struct {
+	TagId              string `json:"tag_id,omitempty"`
+	Sex                string `json:"sex,omitempty"`
+	Country            string `json:"country,omitempty"`
+	Province           string `json:"province,omitempty"`
+	City               string `json:"city,omitempty"`
+	ClientPlatformType string `json:"client_platform_type,omitempty"`
+	Language           string `json:"language,omitempty"`
+}
+
+func (m *menuDefine) validate() error {
+	if len(m.Button) == 0 {
+		return errors.New("menu has no button")
+	}
+	if len(m.Button) > menuButtonLimit {
+		return fmt.Errorf("menu has more than %d buttons", menuButtonLimit)
+	}
+	for i, b := range m.Button {
+		path := fmt.Sprintf("button[%d]", i)
+		if len(b.Name) > menuNameLimit {
+			return fmt.Errorf("%s: name longer than %d bytes", path, menuNameLimit)
+		}
+		if len(b.SubButton) == 0 {
+			if err := b.validate(path); err != nil {
+				return err
+			}
+			continue
+		}
+		if len(b.SubButton) > menuSubButtonLimit {
+			return fmt.Errorf("%s: more than %d sub buttons", path, menuSubButtonLimit)
+		}
+		for j, sub := range b.SubButton {
+			path := fmt.Sprintf("%s.sub_button[%d]", path, j)
+			if len(sub.SubButton) > 0 {
+				return fmt.Errorf("%s: sub button can not have sub buttons", path)
+			}
+			if len(sub.Name) > menuSubNameLimit {
+				return fmt.Errorf("%s: name longer than %d bytes", path, menuSubNameLimit)
+			}
+			if err := sub.validate(path); err != nil {
+				return err
+			}
+		}
+	}
+	if m.MatchRule != nil && *m.MatchRule == (menuMatchRule{}) {
+		return errors.New("matchrule is empty")
+	}
+	return nil
+}
+
+func (b *menuButton) validate(path string) error {
+	if b.Name == "" {
+		return fmt.Errorf("%s: name required", path)
+	}
+	fields, ok := menuButtonTypes[b.Type]
+	if !ok {
+		return fmt.Errorf("%s: invalid type %q", path, b.Type)
+	}
+	values := map[string]string{
+		"key":      b.Key,
+		"url":      b.Url,
+		"media_id": b.MediaId,
+		"appid":    b.AppId,
+		"pagepath": b.PagePath,
+	}
+	for _, f := range fields {
+		if values[f] == "" {
+			return fmt.Errorf("%s: %s required for type %s", path, f, b.Type)
+		}
+	}
+	if len(b.Key) > menuKeyLimit {
+		return fmt.Errorf("%s: key longer than %d bytes", path, menuKeyLimit)
+	}
+	if len(b.Url) > menuUrlLimit {
+		return fmt.Errorf("%s: url longer than %d bytes", path, menuUrlLimit)
+	}
+	return nil
+}
+
+// compare two menu definitions, return changes like "+ path: value", "- path: value", "~ path: old -> new"
+func menuDiff(from, to string) (changes []string, err error) {
+	m1, m2 := make(map[string]string), make(map[string]string)
+	for _, v := range []struct {
+		body string
+		m    map[string]string
+	}{{from, m1}, {to, m2}} {
+		var obj interface{}
+		err = json.Unmarshal([]byte(v.body), &obj)
+		if err != nil {
+			return
+		}
+		flattenJson(obj, "", v.m)
+	}
+
+	for k, v1 := range m1 {
+		v2, ok := m2[k]
+		if !ok {
+			changes = append(changes, fmt.Sprintf("- %s: %s", k, v1))
+		} else if v1 != v2 {
+			changes = append(changes, fmt.Sprintf("~ %s: %s -> %s", k, v1, v2))
+		}
+	}
+	for k, v2 := range m2 {
+		if _, ok := m1[k]; !ok {
+			changes = append(changes, fmt.Sprintf("+ %s: %s", k, v2))
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i][2:] < changes[j][2:]
+	})
+	return
+}
+
+func flattenJson(obj interface{}, prefix string, m map[string]string) {
+	switch v := obj.(type) {
+	case map[string]interface{}:
+		for k, value := range v {
+			key := k
+			if prefix != "" {
+				key = prefix + "." + k
+			}
+			flattenJson(value, key, m)
+		}
+	case []interface{}:
+		for i, value := range v {
+			flattenJson(value, fmt.Sprintf("%s[%d]", prefix, i), m)
+		}
+	default:
+		m[prefix] = fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,93 @@
+package wrap
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestMenuValidate(t *testing.T) {
+	ts_data := []struct {
+		Menu  string
+		Valid bool
+	}{
+		{
+			Menu:  `{"button":[{"type":"click","name":"today","key":"V1001_TODAY_MUSIC"}]}`,
+			Valid: true,
+		},
+		{
+			Menu: `{"button":[{"name":"menu","sub_button":[
+				{"type":"view","name":"search","url":"http://www.soso.com/"},
+				{"type":"miniprogram","name":"wxa","url":"http://mp.weixin.qq.com","appid":"wx286b93c14bbf93aa","pagepath":"pages/lunar/index"}
+			]}]}`,
+			Valid: true,
+		},
+		{
+			Menu:  `{"button":[{"type":"view","name":"search"}]}`,
+			Valid: false,
+		},
+		{
+			Menu:  `{"button":[{"type":"unknown","name":"test","key":"k"}]}`,
+			Valid: false,
+		},
+		{
+			Menu: `{"button":[
+				{"type":"click","name":"1","key":"1"},
+				{"type":"click","name":"2","key":"2"},
+				{"type":"click","name":"3","key":"3"},
+				{"type":"click","name":"4","key":"4"}
+			]}`,
+			Valid: false,
+		},
+		{
+			Menu: `{"button":[{"name":"menu","sub_button":[
+				{"type":"click","name":"1","key":"1"},
+				{"type":"click","name":"2","key":"2"},
+				{"type":"click","name":"3","key":"3"},
+				{"type":"click","name":"4","key":"4"},
+				{"type":"click","name":"5","key":"5"},
+				{"type":"click","name":"6","key":"6"}
+			]}]}`,
+			Valid: false,
+		},
+		{
+			Menu:  `{"button":[{"type":"click","name":"today","key":"k"}],"matchrule":{}}`,
+			Valid: false,
+		},
+	}
+
+	for i, v := range ts_data {
+		m := &menuDefine{}
+		err := json.Unmarshal([]byte(v.Menu), m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = m.validate()
+		if (err == nil) != v.Valid {
+			t.Fatalf("menu %d: %v", i, err)
+		}
+	}
+}
+
+func TestMenuDiff(t *testing.T) {
+	from := `{"button":[{"type":"click","name":"today","key":"k1"},{"type":"view","name":"search","url":"http://a"}]}`
+	to := `{"button":[{"type":"click","name":"today","key":"k2"}]}`
+
+	changes, err := menuDiff(from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"~ button[0].key: k1 -> k2",
+		"- button[1].name: search",
+		"- button[1].type: view",
+		"- button[1].url: http://a",
+	}
+	if len(changes) != len(expected) {
+		t.Fatal(changes)
+	}
+	for i := range expected {
+		if changes[i] != expected[i] {
+			t.Fatal(changes)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package wrap
+
+import (
+	"net/http"
+	wx "wechat-proxy/wechat"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// prometheus metrics, admin token is required if set.
+type MetricsServer struct {
+	AdminToken string
+	handler    http.Handler
+}
+
+func NewMetricsServer() *MetricsServer {
+	return &MetricsServer{handler: promhttp.Handler()}
+}
+
+func (srv *MetricsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if srv.AdminToken != "" && !isAdminToken(headerToken(r), srv.AdminToken) {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write(wx.NewErrorStr("unauthorized").Serialize())
+		return
+	}
+	srv.handler.ServeHTTP(w, r)
+}
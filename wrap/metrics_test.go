@@ -0,0 +1,27 @@
+package wrap
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsServer(t *testing.T) {
+	srv := NewMetricsServer()
+	srv.AdminToken = "admin-token"
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatal(w.Code)
+	}
+
+	r := httptest.NewRequest("GET", "/metrics", nil)
+	r.Header.Set("Authorization", "Bearer admin-token")
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "wxproxy_cache_items") {
+		t.Fatal(w.Code, w.Body.String())
+	}
+}
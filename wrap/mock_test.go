@@ -0,0 +1,36 @@
+package wrap
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	wx "wechat-proxy/wechat"
+)
+
+// mock of wechat api and /api of the proxy, servers under test are mounted on mux
+func newWechatMock(t *testing.T, mux *http.ServeMux) *httptest.Server {
+	mux.HandleFunc("/api", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"access_token":"TOKEN","expires_in":7200}`))
+	})
+	ts := httptest.NewServer(mux)
+	base := wx.ApiBaseUrl
+	wx.ApiBaseUrl = ts.URL
+	t.Cleanup(func() {
+		wx.ApiBaseUrl = base
+		ts.Close()
+	})
+	return ts
+}
+
+// request served under /app/<key>/ of the app
+func withApp(r *http.Request, app *WxApp) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), appContextKey{}, app))
+}
+
+// handler served as if forwarded under /app/<key>/ of the app
+func asApp(h http.Handler, app *WxApp) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, withApp(r, app))
+	})
+}
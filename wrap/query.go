@@ -0,0 +1,159 @@
+package wrap
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	wx "wechat-proxy/wechat"
+)
+
+const (
+	queryDefaultLimit = 100
+	queryMaxLimit     = 1000
+)
+
+var zeroTime = time.Unix(0, 0)
+
+// sortable columns of WxUser
+var userSortFields = map[string]func(a, b *WxUser) bool{
+	"openid":           func(a, b *WxUser) bool { return a.OpenId < b.OpenId },
+	"nickname":         func(a, b *WxUser) bool { return a.Nickname < b.Nickname },
+	"subscribe_time":   func(a, b *WxUser) bool { return a.SubscribeTime < b.SubscribeTime },
+	"unsubscribe_time": func(a, b *WxUser) bool { return a.UnSubscribeTime < b.UnSubscribeTime },
+	"location_time":    func(a, b *WxUser) bool { return a.LocationTime < b.LocationTime },
+}
+
+// conditions of user query, empty field means no limit
+type UserQuery struct {
+	AppId     string
+	OpenId    string
+	UnionId   string
+	Subscribe *bool
+	Nickname  string // substring of nickname
+	Tag       string // tag id
+	Province  string
+	City      string
+	Begin     uint64 // subscribe time range [Begin, End)
+	End       uint64
+	Sort      string // column name, prefix "-" for descending
+	Offset    int
+	Limit     int
+}
+
+// /user?appid=...&openid=&unionid=&subscribe=&nickname=&tag=&province=&city=&begin=&end=&sort=&offset=&limit=
+func (srv *WechatUserServer) query(w http.ResponseWriter, r *http.Request) {
+	queryUsers(w, parseUserQuery(r.Form))
+}
+
+func parseUserQuery(f url.Values) (q *UserQuery) {
+	q = &UserQuery{
+		AppId:    f.Get("appid"),
+		OpenId:   f.Get("openid"),
+		UnionId:  f.Get("unionid"),
+		Nickname: f.Get("nickname"),
+		Tag:      f.Get("tag"),
+		Province: f.Get("province"),
+		City:     f.Get("city"),
+		Sort:     f.Get("sort"),
+	}
+	if v := f.Get("subscribe"); v != "" {
+		subscribe := v == "1" || strings.EqualFold(v, "true")
+		q.Subscribe = &subscribe
+	}
+	if v := f.Get("begin"); v != "" {
+		q.Begin = uint64(parseTime(v, zeroTime).Unix())
+	}
+	if v := f.Get("end"); v != "" {
+		q.End = uint64(parseTime(v, zeroTime).Unix())
+	}
+	q.Offset, _ = strconv.Atoi(f.Get("offset"))
+	q.Limit, _ = strconv.Atoi(f.Get("limit"))
+	return
+}
+
+func queryUsers(w http.ResponseWriter, q *UserQuery) {
+	users, total, err := NewStorage().QueryUsers(q)
+	if err != nil {
+		w.Write(wx.JsonResponse(err))
+		return
+	}
+	w.Write(wx.JsonResponse(&struct {
+		Total int
+		Users []*WxUser
+	}{total, users}))
+}
+
+func (q *UserQuery) normalize() {
+	if q.Offset < 0 {
+		q.Offset = 0
+	}
+	if q.Limit <= 0 {
+		q.Limit = queryDefaultLimit
+	}
+	if q.Limit > queryMaxLimit {
+		q.Limit = queryMaxLimit
+	}
+	if _, ok := userSortFields[strings.TrimPrefix(q.Sort, "-")]; !ok {
+		q.Sort = "openid"
+	}
+}
+
+func (q *UserQuery) match(u *WxUser) bool {
+	switch {
+	case u.AppId != q.AppId:
+		return false
+	case q.OpenId != "" && u.OpenId != q.OpenId:
+		return false
+	case q.UnionId != "" && u.UnionId != q.UnionId:
+		return false
+	case q.Subscribe != nil && u.Subscribe != *q.Subscribe:
+		return false
+	case q.Nickname != "" && !strings.Contains(u.Nickname, q.Nickname):
+		return false
+	case q.Tag != "" && !strings.Contains(u.Tags, ","+q.Tag+","):
+		return false
+	case q.Province != "" && u.Province != q.Province:
+		return false
+	case q.City != "" && u.City != q.City:
+		return false
+	case q.Begin > 0 && u.SubscribeTime < q.Begin:
+		return false
+	case q.End > 0 && u.SubscribeTime >= q.End:
+		return false
+	}
+	return true
+}
+
+// filter, sort and paginate users in memory
+func (q *UserQuery) apply(users []*WxUser) (page []*WxUser, total int) {
+	q.normalize()
+
+	var matched []*WxUser
+	for _, u := range users {
+		if q.match(u) {
+			matched = append(matched, u)
+		}
+	}
+	less := userSortFields[strings.TrimPrefix(q.Sort, "-")]
+	desc := strings.HasPrefix(q.Sort, "-")
+	sort.SliceStable(matched, func(i, j int) bool {
+		if desc {
+			return less(matched[j], matched[i])
+		}
+		return less(matched[i], matched[j])
+	})
+
+	total = len(matched)
+	if q.Offset >= total {
+		return
+	}
+	end := q.Offset + q.Limit
+	if end > total {
+		end = total
+	}
+	page = matched[q.Offset:end]
+	return
+}
@@ -0,0 +1,75 @@
+package wrap
+
+import (
+	"testing"
+)
+
+func TestUserQuery(t *testing.T) {
+	users := []*WxUser{
+		{AppId: "wx1", OpenId: "o1", Nickname: "alice", Subscribe: true, SubscribeTime: 300, Province: "Beijing", Tags: ",2,101,"},
+		{AppId: "wx1", OpenId: "o2", Nickname: "bob", Subscribe: false, SubscribeTime: 100, Province: "Shanghai"},
+		{AppId: "wx1", OpenId: "o3", Nickname: "alina", Subscribe: true, SubscribeTime: 200, Province: "Beijing", Tags: ",101,"},
+		{AppId: "wx2", OpenId: "o4", Nickname: "alice", Subscribe: true, SubscribeTime: 400},
+	}
+	subscribed := true
+
+	ts_data := []struct {
+		Query  UserQuery
+		Total  int
+		Result []string
+	}{
+		{
+			Query:  UserQuery{AppId: "wx1"},
+			Total:  3,
+			Result: []string{"o1", "o2", "o3"},
+		},
+		{
+			Query:  UserQuery{AppId: "wx1", Nickname: "ali", Sort: "-subscribe_time"},
+			Total:  2,
+			Result: []string{"o1", "o3"},
+		},
+		{
+			Query:  UserQuery{AppId: "wx1", Subscribe: &subscribed, Tag: "2"},
+			Total:  1,
+			Result: []string{"o1"},
+		},
+		{
+			Query:  UserQuery{AppId: "wx1", Province: "Beijing", Begin: 100, End: 300},
+			Total:  1,
+			Result: []string{"o3"},
+		},
+		{
+			Query:  UserQuery{AppId: "wx1", Sort: "subscribe_time", Offset: 1, Limit: 1},
+			Total:  3,
+			Result: []string{"o3"},
+		},
+	}
+
+	for i, v := range ts_data {
+		page, total := v.Query.apply(users)
+		if total != v.Total || len(page) != len(v.Result) {
+			t.Fatalf("query %d: total %d, page %d", i, total, len(page))
+		}
+		for j, u := range page {
+			if u.OpenId != v.Result[j] {
+				t.Fatalf("query %d: result %d is %s", i, j, u.OpenId)
+			}
+		}
+	}
+}
+
+func TestUserTags(t *testing.T) {
+	u := &WxUser{}
+	u.setTags([]int{2, 101})
+	if u.Tags != ",2,101," {
+		t.Fatal(u.Tags)
+	}
+	ids := u.tagIds()
+	if len(ids) != 2 || ids[0] != 2 || ids[1] != 101 {
+		t.Fatal(ids)
+	}
+	u.setTags(nil)
+	if u.Tags != "" || len(u.tagIds()) != 0 {
+		t.Fatal(u.Tags)
+	}
+}
@@ -1,13 +1,20 @@
 package wrap
 
 import (
-	"log"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
 	"net/http"
+	"strings"
+	"time"
 	wx "wechat-proxy/wechat"
 )
 
 type RegisterServer struct {
 	wx.WechatClient
+	AdminToken string // 管理员令牌
+	Open       bool   // 未设置管理员令牌时，允许不带凭据的请求注册无所有者的 app (需要正确的 appid 和 secret)
 }
 
 func NewRegisterServer() *RegisterServer {
@@ -15,27 +22,72 @@ func NewRegisterServer() *RegisterServer {
 }
 
 func (srv *RegisterServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	log.Println(r.RequestURI)
+	wx.Debugln(r.RequestURI)
 	r.ParseForm()
 	f := r.Form
 
+	// check admin token or tenant api key
+	owner, admin, wxErr := srv.caller(r)
+	if wxErr != nil {
+		w.Write(wxErr.Serialize())
+		return
+	}
+
+	if strings.HasSuffix(r.URL.Path, "/tenant") {
+		srv.tenant(w, r, admin)
+		return
+	}
+
 	// get necessary parameters
 	key, appid, secret := f.Get("key"), f.Get("appid"), f.Get("secret")
 
+	// expired apps are kept with their owner and settings, they are renewed or deleted as others
+	app, err := NewStorage().LoadApp(key)
+	if err == ErrNotFound {
+		app = nil
+	} else if err != nil && err != ErrExpired {
+		w.Write(storageError(err).Serialize())
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		if owner == "" && !admin {
+			w.Write(wx.NewErrorStr("unauthorized").Serialize())
+			return
+		}
+		if app == nil {
+			w.Write(storageError(err).Serialize())
+			return
+		}
+		wxErr = srv.checkPrivilage(app, owner, admin)
+		if wxErr != nil {
+			w.Write(wxErr.Serialize())
+			return
+		}
+		err = NewStorage().DeleteApp(key)
+		w.Write(wx.JsonResponse(err))
+		return
+	}
+
 	// check appid and secret
-	_, wxErr := srv.GetAccessToken(srv.HostUrl(r), appid, secret)
+	_, wxErr = srv.GetAccessToken(srv.HostUrl(r), appid, secret)
 	if wxErr != nil {
 		w.Write(wxErr.Serialize())
 		return
 	}
 
 	// check key and appid
-	app, err := NewStorage().LoadApp(key)
-	if err != nil {
+	resetSecret := f.Get("reset_secret") == "true"
+	if app == nil {
 		app = &WxApp{
 			Key: key,
 			AppId: appid,
 			Secret: secret,
+			Owner: owner,
+		}
+		resetSecret = true
+		if admin {
+			app.Owner = f.Get("owner")
 		}
 	} else {
 		if app.AppId != appid {
@@ -43,6 +95,14 @@ func (srv *RegisterServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			w.Write(wxErr.Serialize())
 			return
 		}
+		wxErr = srv.checkPrivilage(app, owner, admin)
+		if wxErr != nil {
+			w.Write(wxErr.Serialize())
+			return
+		}
+		if admin && f.Get("owner") != "" {
+			app.Owner = f.Get("owner")
+		}
 	}
 
 	// merge parameters
@@ -55,19 +115,187 @@ func (srv *RegisterServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		case "server_ip": app.IpAddress = f.Get("server_ip")
 		case "call": app.setCalls(f["call"])
 		case "expires": app.setExpires(f.Get("expires"))
+		case "allow_ip": app.setAllowIps(f["allow_ip"])
 		}
 	}
 
+	// issue client secret for new app, or reissue on request
+	clientSecret := ""
+	if resetSecret {
+		clientSecret, err = randomKey()
+		if err != nil {
+			w.Write(wx.JsonResponse(err))
+			return
+		}
+		app.ClientSecret = clientSecret
+	}
+
 	// store app info
 	err = NewStorage().SaveApp(app)
 	if err != nil {
 		w.Write(wx.JsonResponse(err))
 		return
 	}
+	if clientSecret != "" {
+		w.Write(wx.JsonResponse(&struct {
+			Success      bool   `json:"success"`
+			ClientSecret string `json:"client_secret"`
+		}{true, clientSecret}))
+		return
+	}
 	w.Write(wx.JsonResponse(nil))
 	return
 }
 
-func (srv *RegisterServer) checkPrivilage(key, appid, secret string) (wxErr wx.WxError) {
+// only admin or owner of the app can modify or delete it,
+// anonymous callers (no admin token configured) can only modify apps without owner.
+func (srv *RegisterServer) checkPrivilage(app *WxApp, owner string, admin bool) (wxErr *wx.WxError) {
+	if admin {
+		return
+	}
+	if owner == "" {
+		if app.Owner != "" {
+			wxErr = wx.NewErrorStr("permission denied")
+		}
+		return
+	}
+	if app.Owner == "" || app.Owner != owner {
+		wxErr = wx.NewErrorStr("permission denied")
+	}
+	return
+}
+
+// identify caller by admin token or tenant api key.
+// the credential is read from header "Authorization: Bearer ...", header X-Api-Key or parameter api_key.
+// callers without credential are anonymous (empty owner) only if open and admin token is not configured.
+func (srv *RegisterServer) caller(r *http.Request) (owner string, admin bool, wxErr *wx.WxError) {
+	token := headerToken(r)
+	if token == "" {
+		token = r.Form.Get("api_key")
+	}
+	if token == "" && srv.AdminToken == "" && srv.Open {
+		return
+	}
+	if token == "" {
+		wxErr = wx.NewErrorStr("unauthorized")
+		return
+	}
+
+	if isAdminToken(token, srv.AdminToken) {
+		admin = true
+		return
+	}
+	t, err := NewStorage().LoadTenant(apiKeyHash(token))
+	if err != nil || t.Name == "" {
+		wxErr = wx.NewErrorStr("unauthorized")
+		return
+	}
+	owner = t.Name
+	return
+}
+
+// /register/tenant?name=...   (POST: issue api key, DELETE: revoke all api keys of the tenant)
+func (srv *RegisterServer) tenant(w http.ResponseWriter, r *http.Request, admin bool) {
+	if !admin {
+		w.Write(wx.NewErrorStr("permission denied").Serialize())
+		return
+	}
+	name := r.Form.Get("name")
+	if name == "" {
+		w.Write(wx.NewErrorStr("name is required").Serialize())
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		apiKey, err := randomKey()
+		if err != nil {
+			w.Write(wx.JsonResponse(err))
+			return
+		}
+		err = NewStorage().SaveTenant(&WxTenant{
+			ApiKey:     apiKeyHash(apiKey),
+			Name:       name,
+			CreateTime: uint64(time.Now().Unix()),
+		})
+		if err != nil {
+			w.Write(wx.JsonResponse(err))
+			return
+		}
+		w.Write(wx.JsonResponse(&struct {
+			Name   string
+			ApiKey string
+		}{name, apiKey}))
+	case http.MethodDelete:
+		err := NewStorage().DeleteTenant(name)
+		w.Write(wx.JsonResponse(err))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// api keys are stored as sha256 digest
+func apiKeyHash(apiKey string) string {
+	sum := sha256.Sum256([]byte(apiKey))
+	return hex.EncodeToString(sum[:])
+}
+
+// credential in header "Authorization: Bearer ..." or X-Api-Key
+func headerToken(r *http.Request) string {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		token = r.Header.Get("X-Api-Key")
+	}
+	return token
+}
+
+func isAdminToken(token, adminToken string) bool {
+	return adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+// app registered by config file
+type AppConfig struct {
+	Key          string   `yaml:"key"`
+	AppId        string   `yaml:"appid"`
+	Secret       string   `yaml:"secret"`
+	Token        string   `yaml:"token"`
+	AesKey       string   `yaml:"aes"`
+	MchId        string   `yaml:"mch_id"`
+	MchKey       string   `yaml:"mch_key"`
+	IpAddress    string   `yaml:"server_ip"`
+	Calls        []string `yaml:"calls"`
+	AllowIps     []string `yaml:"allow_ips"`
+	ClientSecret string   `yaml:"client_secret"`
+	Unsigned     bool     `yaml:"unsigned"`
+	Owner        string   `yaml:"owner"`
+}
+
+// save apps of config file, registrations with the same key are replaced.
+func RegisterApps(apps []AppConfig) (err error) {
+	for _, v := range apps {
+		if v.Key == "" || v.AppId == "" {
+			err = fmt.Errorf("key and appid are required: %q", v.Key)
+			return
+		}
+		app := &WxApp{
+			Key:          v.Key,
+			AppId:        v.AppId,
+			Secret:       v.Secret,
+			Token:        v.Token,
+			AesKey:       v.AesKey,
+			MchId:        v.MchId,
+			MchKey:       v.MchKey,
+			IpAddress:    v.IpAddress,
+			Owner:        v.Owner,
+			ClientSecret: v.ClientSecret,
+			Unsigned:     v.Unsigned,
+		}
+		app.setCalls(v.Calls)
+		app.setAllowIps(v.AllowIps)
+		err = NewStorage().SaveApp(app)
+		if err != nil {
+			return
+		}
+	}
 	return
 }
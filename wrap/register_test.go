@@ -0,0 +1,177 @@
+package wrap
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegisterCaller(t *testing.T) {
+	srv := NewRegisterServer()
+	srv.AdminToken = "admin-token"
+	NewStorage().SaveTenant(&WxTenant{ApiKey: apiKeyHash("tenant-key"), Name: "t1"})
+
+	ts_data := []struct {
+		Header string
+		Value  string
+		Owner  string
+		Admin  bool
+		Ok     bool
+	}{
+		{"Authorization", "Bearer admin-token", "", true, true},
+		{"X-Api-Key", "tenant-key", "t1", false, true},
+		{"X-Api-Key", "admin-token1", "", false, false},
+		{"Authorization", "Bearer unknown", "", false, false},
+		{"", "", "", false, false},
+	}
+	for _, v := range ts_data {
+		r := httptest.NewRequest("POST", "/register?key=test", nil)
+		r.ParseForm()
+		if v.Header != "" {
+			r.Header.Set(v.Header, v.Value)
+		}
+		owner, admin, wxErr := srv.caller(r)
+		if owner != v.Owner || admin != v.Admin || (wxErr == nil) != v.Ok {
+			t.Fatal(v, owner, admin, wxErr)
+		}
+	}
+}
+
+func TestRegisterPrivilage(t *testing.T) {
+	srv := NewRegisterServer()
+	app := &WxApp{Key: "test", Owner: "t1"}
+	if srv.checkPrivilage(app, "", true) != nil {
+		t.Fatal("admin denied")
+	}
+	if srv.checkPrivilage(app, "t1", false) != nil {
+		t.Fatal("owner denied")
+	}
+	if srv.checkPrivilage(app, "t2", false) == nil {
+		t.Fatal("other tenant allowed")
+	}
+	if srv.checkPrivilage(&WxApp{Key: "test"}, "t1", false) == nil {
+		t.Fatal("tenant allowed on app without owner")
+	}
+	if srv.checkPrivilage(&WxApp{Key: "test"}, "", false) != nil {
+		t.Fatal("anonymous denied on app without owner")
+	}
+	if srv.checkPrivilage(app, "", false) == nil {
+		t.Fatal("anonymous allowed on app of tenant")
+	}
+}
+
+func TestRegisterOpen(t *testing.T) {
+	srv := NewRegisterServer()
+	NewStorage().SaveTenant(&WxTenant{ApiKey: apiKeyHash("open-key"), Name: "t-open"})
+
+	// anonymous callers are rejected unless open
+	r := httptest.NewRequest("POST", "/register?key=test", nil)
+	r.ParseForm()
+	if _, _, wxErr := srv.caller(r); wxErr == nil {
+		t.Fatal("anonymous caller accepted")
+	}
+	srv.AdminToken = "admin-token"
+	srv.Open = true
+	if _, _, wxErr := srv.caller(r); wxErr == nil {
+		t.Fatal("anonymous caller accepted with admin token")
+	}
+
+	// without admin token, callers without credential are anonymous if open
+	srv.AdminToken = ""
+	owner, admin, wxErr := srv.caller(r)
+	if owner != "" || admin || wxErr != nil {
+		t.Fatal(owner, admin, wxErr)
+	}
+
+	// tenant api keys still work
+	r.Header.Set("X-Api-Key", "open-key")
+	if owner, _, wxErr := srv.caller(r); owner != "t-open" || wxErr != nil {
+		t.Fatal(owner, wxErr)
+	}
+
+	// anonymous callers can't create tenants or delete apps
+	ts_data := []struct {
+		Method string
+		Path   string
+	}{
+		{"POST", "/register/tenant?name=t2"},
+		{"DELETE", "/register?key=test"},
+	}
+	for _, v := range ts_data {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest(v.Method, v.Path, nil))
+		if !strings.Contains(w.Body.String(), "errcode") || strings.Contains(w.Body.String(), `"errcode":0`) {
+			t.Fatal(v, w.Body.String())
+		}
+	}
+}
+
+func TestRegisterExpired(t *testing.T) {
+	mux := http.NewServeMux()
+	srv := NewRegisterServer()
+	srv.AdminToken = "admin-token"
+	mux.Handle("/register", srv)
+	ts := newWechatMock(t, mux)
+	NewStorage().SaveTenant(&WxTenant{ApiKey: apiKeyHash("expired-a"), Name: "t-exp-a"})
+	NewStorage().SaveTenant(&WxTenant{ApiKey: apiKeyHash("expired-b"), Name: "t-exp-b"})
+
+	expired := time.Now().Add(-time.Minute)
+	victim := &WxApp{Key: "victim", AppId: "wx-victim", Secret: "s", Token: "tok", MchId: "mch", Owner: "t-exp-a", ClientSecret: "cs", Expires: &expired}
+	if err := NewStorage().SaveApp(victim); err != nil {
+		t.Fatal(err)
+	}
+	defer NewStorage().DeleteApp("victim")
+
+	call := func(method, query, apiKey string) string {
+		req, _ := http.NewRequest(method, ts.URL+"/register?key=victim&"+query, nil)
+		req.Header.Set("X-Api-Key", apiKey)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		return string(body)
+	}
+
+	// expired key is not taken over by other owners
+	ts_data := []struct {
+		Method string
+		Query  string
+		Error  string
+	}{
+		{"POST", "appid=wx-other&secret=s", "key exists"},
+		{"POST", "appid=wx-victim&secret=s&expires=3600", "permission denied"},
+		{"DELETE", "", "permission denied"},
+	}
+	for _, v := range ts_data {
+		if body := call(v.Method, v.Query, "expired-b"); !strings.Contains(body, v.Error) {
+			t.Fatal(v, body)
+		}
+	}
+	if app, err := NewStorage().LoadApp("victim"); err != ErrExpired || app.Owner != "t-exp-a" {
+		t.Fatal(app, err)
+	}
+
+	// renewed by owner with settings kept
+	if body := call("POST", "appid=wx-victim&secret=s&expires=3600", "expired-a"); strings.Contains(body, "client_secret") {
+		t.Fatal("client secret is reissued", body)
+	}
+	app, err := NewStorage().LoadApp("victim")
+	if err != nil || app.Owner != "t-exp-a" || app.Token != "tok" || app.MchId != "mch" || app.ClientSecret != "cs" {
+		t.Fatal(app, err)
+	}
+
+	// deleted by owner after expired
+	app.Expires = &expired
+	NewStorage().SaveApp(app)
+	if body := call("DELETE", "", "expired-a"); strings.Contains(body, "expired") {
+		t.Fatal(body)
+	}
+	if _, err := NewStorage().LoadApp("victim"); err != ErrNotFound {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,120 @@
+package wrap
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+	wx "wechat-proxy/wechat"
+)
+
+const reportDefaultDuration = 30 * 24 * time.Hour
+
+// subscribe statistics of a scene qrcode
+type channelStat struct {
+	Scene       string
+	Channel     string
+	Subscribe   int     // 新关注
+	Resubscribe int     // 再次关注
+	Unsubscribe int     // 取消关注
+	Scan        int     // 已关注用户扫码
+	NetGrowth   int     // 净增关注
+	Referred    int     // 时间段内由此渠道关注的用户数
+	Retained    int     // 其中仍在关注的用户数
+	Retention   float64 // 留存率
+}
+
+// /user/report?appid=...&begin=&end=
+func (srv *WechatUserServer) report(w http.ResponseWriter, r *http.Request) {
+	f := r.Form
+	appid := f.Get("appid")
+
+	end := parseTime(f.Get("end"), time.Now())
+	begin := parseTime(f.Get("begin"), end.Add(-reportDefaultDuration))
+
+	events, err := NewStorage().LoadUserEvents(appid, uint64(begin.Unix()), uint64(end.Unix()))
+	if err != nil {
+		w.Write(wx.JsonResponse(err))
+		return
+	}
+	users, err := NewStorage().LoadUsers(appid)
+	if err != nil {
+		w.Write(wx.JsonResponse(err))
+		return
+	}
+	scenes, err := NewStorage().LoadScenes(appid)
+	if err != nil {
+		scenes = nil
+	}
+
+	stats := channelReport(events, users, scenes, uint64(begin.Unix()), uint64(end.Unix()))
+	w.Write(wx.JsonResponse(stats))
+}
+
+func channelReport(events []*WxUserEvent, users []*WxUser, scenes []*WxScene, begin, end uint64) []*channelStat {
+	m := make(map[string]*channelStat)
+	stat := func(scene string) *channelStat {
+		if m[scene] == nil {
+			m[scene] = &channelStat{Scene: scene}
+		}
+		return m[scene]
+	}
+
+	for _, e := range events {
+		s := stat(e.Scene)
+		switch e.Event {
+		case "subscribe":
+			s.Subscribe++
+		case "resubscribe":
+			s.Resubscribe++
+		case "unsubscribe":
+			s.Unsubscribe++
+		case "scan":
+			s.Scan++
+		}
+	}
+	for _, u := range users {
+		if u.SubscribeTime < begin || u.SubscribeTime >= end {
+			continue
+		}
+		s := stat(u.Referral)
+		s.Referred++
+		if u.Subscribe {
+			s.Retained++
+		}
+	}
+	for _, v := range scenes {
+		if s, ok := m[v.Scene]; ok {
+			s.Channel = v.Channel
+		}
+	}
+
+	stats := make([]*channelStat, 0, len(m))
+	for _, s := range m {
+		s.NetGrowth = s.Subscribe + s.Resubscribe - s.Unsubscribe
+		if s.Referred > 0 {
+			s.Retention = float64(s.Retained) / float64(s.Referred)
+		}
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Scene < stats[j].Scene
+	})
+	return stats
+}
+
+// parse unix timestamp or date string
+func parseTime(str string, def time.Time) time.Time {
+	if str == "" {
+		return def
+	}
+	if n, err := strconv.ParseInt(str, 10, 64); err == nil {
+		return time.Unix(n, 0)
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, str, time.Local); err == nil {
+			return t
+		}
+	}
+	return def
+}
@@ -0,0 +1,54 @@
+package wrap
+
+import (
+	"testing"
+	"time"
+)
+
+func TestChannelReport(t *testing.T) {
+	events := []*WxUserEvent{
+		{OpenId: "u1", Event: "subscribe", Scene: "s1", CreateTime: 100},
+		{OpenId: "u2", Event: "subscribe", Scene: "s1", CreateTime: 110},
+		{OpenId: "u3", Event: "resubscribe", Scene: "s2", CreateTime: 120},
+		{OpenId: "u2", Event: "unsubscribe", Scene: "s1", CreateTime: 130},
+		{OpenId: "u1", Event: "scan", Scene: "s2", CreateTime: 140},
+	}
+	users := []*WxUser{
+		{OpenId: "u1", Subscribe: true, SubscribeTime: 100, Referral: "s1"},
+		{OpenId: "u2", Subscribe: false, SubscribeTime: 110, Referral: "s1"},
+		{OpenId: "u3", Subscribe: true, SubscribeTime: 120, Referral: "s2"},
+		{OpenId: "u4", Subscribe: true, SubscribeTime: 10, Referral: "s2"},
+	}
+	scenes := []*WxScene{
+		{Scene: "s1", Channel: "poster"},
+	}
+
+	stats := channelReport(events, users, scenes, 100, 200)
+	if len(stats) != 2 {
+		t.Fatal(stats)
+	}
+	s1, s2 := stats[0], stats[1]
+	if s1.Channel != "poster" || s1.Subscribe != 2 || s1.Unsubscribe != 1 || s1.NetGrowth != 1 {
+		t.Fatalf("%#v", s1)
+	}
+	if s1.Referred != 2 || s1.Retained != 1 || s1.Retention != 0.5 {
+		t.Fatalf("%#v", s1)
+	}
+	if s2.Resubscribe != 1 || s2.Scan != 1 || s2.NetGrowth != 1 || s2.Referred != 1 || s2.Retention != 1 {
+		t.Fatalf("%#v", s2)
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	def := time.Unix(0, 0)
+	if parseTime("", def) != def {
+		t.Fatal("default time error")
+	}
+	if parseTime("1500000000", def).Unix() != 1500000000 {
+		t.Fatal("timestamp error")
+	}
+	d := parseTime("2017-09-01", def)
+	if d.Year() != 2017 || d.Month() != 9 || d.Day() != 1 {
+		t.Fatal("date error")
+	}
+}
@@ -0,0 +1,197 @@
+package wrap
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	wx "wechat-proxy/wechat"
+)
+
+const (
+	// max expire seconds of temporary qrcode
+	sceneExpireLimit = 30 * 24 * 3600
+
+	// renew temporary qrcode ticket before it expires
+	sceneExpireMargin = 3600
+
+	// max scene_id of permanent qrcode
+	scenePermanentLimit = 100000
+)
+
+// doc: https://mp.weixin.qq.com/wiki?t=resource/res_main&id=mp1443433542
+type WechatSceneServer struct {
+	wx.WechatClient
+}
+
+func NewSceneServer() *WechatSceneServer {
+	srv := &WechatSceneServer{}
+	return srv
+}
+
+// /qrcode/scene?appid=...&secret=...&scene=...&channel=&permanent=&expires=&format=
+// /qrcode/scenes?appid=...
+func (srv *WechatSceneServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	wx.Debugln(r.RequestURI)
+	if _, ok := requireApp(w, r); !ok {
+		return
+	}
+	r.ParseForm()
+	f := r.Form
+	appid := f.Get("appid")
+
+	if strings.HasSuffix(r.URL.Path, "/scenes") {
+		scenes, err := NewStorage().LoadScenes(appid)
+		if err != nil {
+			w.Write(wx.JsonResponse(err))
+			return
+		}
+		w.Write(wx.JsonResponse(scenes))
+		return
+	}
+
+	scene, err := srv.sceneTicket(r)
+	if err != nil {
+		w.Write(wx.JsonResponse(err))
+		return
+	}
+
+	if f.Get("format") == "json" {
+		w.Write(wx.JsonResponse(scene))
+		return
+	}
+	resp, err := http.Get(scene.TicketUrl())
+	if err != nil {
+		w.Write(wx.JsonResponse(err))
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		w.Write(wx.NewErrorStr("qrcode image: " + resp.Status).Serialize())
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "max-age=3600")
+	io.Copy(w, resp.Body)
+}
+
+// load cached scene ticket or create new one
+func (srv *WechatSceneServer) sceneTicket(r *http.Request) (scene *WxScene, err error) {
+	f := r.Form
+	appid, secret := f.Get("appid"), f.Get("secret")
+	key := f.Get("scene")
+	if key == "" || len(key) > 64 {
+		err = errors.New("scene must be 1 to 64 characters")
+		return
+	}
+	permanent := strings.EqualFold(f.Get("permanent"), "true")
+	id, e := strconv.ParseUint(key, 10, 32)
+	isId := e == nil && id > 0
+	if permanent && isId && id > scenePermanentLimit {
+		err = fmt.Errorf("permanent scene id must be 1 to %d", scenePermanentLimit)
+		return
+	}
+	expires, _ := strconv.Atoi(f.Get("expires"))
+	if expires <= 0 || expires > sceneExpireLimit {
+		expires = sceneExpireLimit
+	}
+
+	now := uint64(time.Now().Unix())
+	scene, err = NewStorage().LoadScene(appid, key)
+	if err != nil {
+		scene = &WxScene{
+			AppId:      appid,
+			Scene:      key,
+			CreateTime: now,
+		}
+	}
+	if f.Get("channel") != "" {
+		scene.Channel = f.Get("channel")
+	}
+	if scene.Ticket != "" && scene.Permanent == permanent &&
+		(permanent || scene.ExpireTime > now+sceneExpireMargin) {
+		err = NewStorage().SaveScene(scene)
+		return
+	}
+
+	// create qrcode ticket
+	req := map[string]interface{}{}
+	info := map[string]interface{}{}
+	if isId {
+		info["scene_id"] = id
+		req["action_name"] = "QR_SCENE"
+	} else {
+		info["scene_str"] = key
+		req["action_name"] = "QR_STR_SCENE"
+	}
+	if permanent {
+		req["action_name"] = strings.Replace(req["action_name"].(string), "QR_", "QR_LIMIT_", 1)
+	} else {
+		req["expire_seconds"] = expires
+	}
+	req["action_info"] = map[string]interface{}{"scene": info}
+
+	access_token, wxErr := srv.GetAccessToken(srv.HostUrl(r), appid, secret)
+	if wxErr != nil {
+		err = errors.New(wxErr.String())
+		return
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return
+	}
+	_url := fmt.Sprintf(wx.ApiBaseUrl+"/cgi-bin/qrcode/create?access_token=%s", access_token)
+	resp, err := http.Post(_url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+	t := &struct {
+		wx.WxError
+		Ticket        string `json:"ticket"`
+		ExpireSeconds uint64 `json:"expire_seconds"`
+		Url           string `json:"url"`
+	}{}
+	err = json.Unmarshal(body, t)
+	if err != nil {
+		return
+	}
+	if !t.Success() {
+		err = errors.New(t.String())
+		return
+	}
+
+	scene.Permanent = permanent
+	scene.Ticket = t.Ticket
+	scene.Url = t.Url
+	scene.ExpireTime = 0
+	if !permanent {
+		scene.ExpireTime = now + t.ExpireSeconds
+	}
+	err = NewStorage().SaveScene(scene)
+	return
+}
+
+// url of qrcode image
+func (s *WxScene) TicketUrl() string {
+	return wx.MpBaseUrl + "/cgi-bin/showqrcode?ticket=" + url.QueryEscape(s.Ticket)
+}
+
+func (s *WxScene) MarshalJSON() ([]byte, error) {
+	type scene WxScene
+	return json.Marshal(&struct {
+		*scene
+		TicketUrl string
+	}{(*scene)(s), s.TicketUrl()})
+}
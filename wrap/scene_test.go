@@ -0,0 +1,83 @@
+package wrap
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	wx "wechat-proxy/wechat"
+)
+
+func TestSceneTicket(t *testing.T) {
+	var created []map[string]interface{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cgi-bin/qrcode/create", func(w http.ResponseWriter, r *http.Request) {
+		var req map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&req)
+		created = append(created, req)
+		w.Write([]byte(`{"ticket":"TICKET","expire_seconds":86400,"url":"http://weixin.qq.com/q/abc"}`))
+	})
+	mux.HandleFunc("/cgi-bin/showqrcode", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/jpg")
+		w.Write([]byte{0xff, 0xd8, 0xff, 0xe0})
+	})
+	mux.Handle("/qrcode/scene", asApp(NewSceneServer(), &WxApp{Key: "scene", AppId: "wx-scene"}))
+	ts := newWechatMock(t, mux)
+	defer func(base string) { wx.MpBaseUrl = base }(wx.MpBaseUrl)
+	wx.MpBaseUrl = ts.URL
+
+	ts_data := []struct {
+		Query  string
+		Action string
+		Error  string
+	}{
+		{"scene=100001&permanent=true", "", "1 to 100000"},
+		{"scene=" + strings.Repeat("s", 65), "", "1 to 64"},
+		{"scene=100000&permanent=true", "QR_LIMIT_SCENE", ""},
+		{"scene=100001", "QR_SCENE", ""},
+		{"scene=promo&expires=60", "QR_STR_SCENE", ""},
+		{"scene=promo&channel=ad", "", ""}, // cached ticket
+		{"scene=promo&permanent=true", "QR_LIMIT_STR_SCENE", ""},
+	}
+	for _, v := range ts_data {
+		n := len(created)
+		resp, err := http.Get(ts.URL + "/qrcode/scene?appid=wx-scene&secret=s&format=json&" + v.Query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if v.Error != "" {
+			if !strings.Contains(string(body), v.Error) || len(created) != n {
+				t.Fatal(v.Query, string(body))
+			}
+			continue
+		}
+		if v.Action == "" {
+			if len(created) != n {
+				t.Fatal("ticket is not cached", v.Query)
+			}
+			continue
+		}
+		if len(created) != n+1 || created[n]["action_name"] != v.Action {
+			t.Fatal(v.Query, string(body))
+		}
+	}
+
+	scene, err := NewStorage().LoadScene("wx-scene", "promo")
+	if err != nil || scene.Channel != "ad" || !scene.Permanent {
+		t.Fatal(scene, err)
+	}
+
+	// image is returned as is
+	resp, err := http.Get(ts.URL + "/qrcode/scene?appid=wx-scene&secret=s&scene=promo&permanent=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.Header.Get("Content-Type") != "image/jpeg" || string(body) != "\xff\xd8\xff\xe0" {
+		t.Fatal(resp.Header, body)
+	}
+}
@@ -0,0 +1,278 @@
+package wrap
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+// encrypted value: enc1:<key id>:<wrapped data key>:<cipher text>
+const secretPrefix = "enc1:"
+
+var (
+	ErrNoMasterKey  = errors.New("master key is not set")
+	ErrUnknownKey   = errors.New("unknown master key")
+	ErrBadSecret    = errors.New("malformed encrypted secret")
+	ErrBadMasterKey = errors.New("master key must be 32 bytes in hex or base64")
+)
+
+// master keys for envelope encryption of secret fields.
+// each value is encrypted by a random data key, and the data key is encrypted by master key.
+type secretBox struct {
+	current string            // id of current master key
+	keys    map[string][]byte // all known master keys by id
+}
+
+var (
+	secretOnce sync.Once
+	secretKeys *secretBox
+	secretErr  error
+)
+
+// master keys from environment:
+// WXPROXY_MASTER_KEY or WXPROXY_MASTER_KEY_FILE for current key,
+// WXPROXY_OLD_MASTER_KEY or WXPROXY_OLD_MASTER_KEY_FILE for key rotation.
+func secrets() (*secretBox, error) {
+	secretOnce.Do(func() {
+		var key, old []byte
+		key, secretErr = readMasterKey("WXPROXY_MASTER_KEY")
+		if secretErr != nil {
+			return
+		}
+		old, secretErr = readMasterKey("WXPROXY_OLD_MASTER_KEY")
+		if secretErr != nil {
+			return
+		}
+		secretKeys = newSecretBox(key, old)
+	})
+	return secretKeys, secretErr
+}
+
+func readMasterKey(env string) (key []byte, err error) {
+	str := os.Getenv(env)
+	if file := os.Getenv(env + "_FILE"); str == "" && file != "" {
+		var bs []byte
+		bs, err = ioutil.ReadFile(file)
+		if err != nil {
+			return
+		}
+		str = string(bs)
+	}
+	str = strings.TrimSpace(str)
+	if str == "" {
+		return
+	}
+	if key, err = hex.DecodeString(str); err == nil && len(key) == 32 {
+		return
+	}
+	if key, err = base64.StdEncoding.DecodeString(str); err == nil && len(key) == 32 {
+		return
+	}
+	key, err = nil, ErrBadMasterKey
+	return
+}
+
+func newSecretBox(key []byte, olds ...[]byte) *secretBox {
+	box := &secretBox{keys: make(map[string][]byte)}
+	for _, k := range olds {
+		if len(k) > 0 {
+			box.keys[keyId(k)] = k
+		}
+	}
+	if len(key) > 0 {
+		box.current = keyId(key)
+		box.keys[box.current] = key
+	}
+	return box
+}
+
+func keyId(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:4])
+}
+
+func isEncrypted(s string) bool {
+	return strings.HasPrefix(s, secretPrefix)
+}
+
+// encrypt with current master key, empty string is kept empty
+func (box *secretBox) encrypt(plain string) (s string, err error) {
+	if plain == "" || isEncrypted(plain) {
+		return plain, nil
+	}
+	if box == nil || box.current == "" {
+		err = ErrNoMasterKey
+		return
+	}
+	dataKey := make([]byte, 32)
+	if _, err = rand.Read(dataKey); err != nil {
+		return
+	}
+	wrapped, err := sealGCM(box.keys[box.current], dataKey)
+	if err != nil {
+		return
+	}
+	data, err := sealGCM(dataKey, []byte(plain))
+	if err != nil {
+		return
+	}
+	s = secretPrefix + box.current + ":" +
+		base64.RawStdEncoding.EncodeToString(wrapped) + ":" +
+		base64.RawStdEncoding.EncodeToString(data)
+	return
+}
+
+// decrypt value, plaintext value is returned as it is
+func (box *secretBox) decrypt(s string) (plain string, err error) {
+	if !isEncrypted(s) {
+		return s, nil
+	}
+	_, dataKey, data, err := box.unwrap(s)
+	if err != nil {
+		return
+	}
+	bs, err := openGCM(dataKey, data)
+	if err != nil {
+		return
+	}
+	plain = string(bs)
+	return
+}
+
+// encrypt plaintext value, or wrap data key again with current master key.
+func (box *secretBox) rekey(s string) (r string, err error) {
+	if !isEncrypted(s) {
+		return box.encrypt(s)
+	}
+	if box == nil || box.current == "" {
+		err = ErrNoMasterKey
+		return
+	}
+	id, dataKey, data, err := box.unwrap(s)
+	if err != nil || id == box.current {
+		return s, err
+	}
+	wrapped, err := sealGCM(box.keys[box.current], dataKey)
+	if err != nil {
+		return
+	}
+	r = secretPrefix + box.current + ":" +
+		base64.RawStdEncoding.EncodeToString(wrapped) + ":" +
+		base64.RawStdEncoding.EncodeToString(data)
+	return
+}
+
+func (box *secretBox) unwrap(s string) (id string, dataKey, data []byte, err error) {
+	parts := strings.Split(strings.TrimPrefix(s, secretPrefix), ":")
+	if len(parts) != 3 {
+		err = ErrBadSecret
+		return
+	}
+	id = parts[0]
+	if box == nil || box.keys[id] == nil {
+		err = fmt.Errorf("%s: %s", ErrUnknownKey.Error(), id)
+		return
+	}
+	wrapped, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return
+	}
+	data, err = base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return
+	}
+	dataKey, err = openGCM(box.keys[id], wrapped)
+	return
+}
+
+// AES-256-GCM, nonce is prepended to cipher text
+func sealGCM(key, plain []byte) (data []byte, err error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return
+	}
+	data = gcm.Seal(nonce, nonce, plain, nil)
+	return
+}
+
+func openGCM(key, data []byte) (plain []byte, err error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return
+	}
+	if len(data) < gcm.NonceSize() {
+		err = ErrBadSecret
+		return
+	}
+	plain, err = gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	return
+}
+
+// secret fields of app
+func (app *WxApp) secretFields() []*string {
+	return []*string{&app.Secret, &app.AesKey, &app.MchKey, &app.ClientSecret}
+}
+
+// encrypted copy of app for storing, secrets are kept plaintext without master key.
+func (app *WxApp) encrypted(box *secretBox) (r *WxApp, err error) {
+	c := *app
+	if box == nil || box.current == "" {
+		r = &c
+		return
+	}
+	for _, p := range c.secretFields() {
+		*p, err = box.encrypt(*p)
+		if err != nil {
+			return
+		}
+	}
+	r = &c
+	return
+}
+
+func (app *WxApp) decrypt(box *secretBox) (err error) {
+	for _, p := range app.secretFields() {
+		*p, err = box.decrypt(*p)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// rekey secret fields, changed is true if any field is updated
+func (app *WxApp) rekey(box *secretBox) (changed bool, err error) {
+	for _, p := range app.secretFields() {
+		var s string
+		s, err = box.rekey(*p)
+		if err != nil {
+			return
+		}
+		if s != *p {
+			*p = s
+			changed = true
+		}
+	}
+	return
+}
@@ -0,0 +1,74 @@
+package wrap
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSecretBox(t *testing.T) {
+	key1 := bytes.Repeat([]byte{1}, 32)
+	key2 := bytes.Repeat([]byte{2}, 32)
+	box1 := newSecretBox(key1)
+
+	s, err := box1.encrypt("secret")
+	if err != nil || !isEncrypted(s) {
+		t.Fatal(s, err)
+	}
+	if plain, err := box1.decrypt(s); err != nil || plain != "secret" {
+		t.Fatal(plain, err)
+	}
+	if plain, err := box1.decrypt("plain"); err != nil || plain != "plain" {
+		t.Fatal(plain, err)
+	}
+	if e, _ := box1.encrypt(""); e != "" {
+		t.Fatal(e)
+	}
+
+	// rotate key1 to key2
+	box2 := newSecretBox(key2, key1)
+	r, err := box2.rekey(s)
+	if err != nil || r == s {
+		t.Fatal(r, err)
+	}
+	if plain, err := box2.decrypt(r); err != nil || plain != "secret" {
+		t.Fatal(plain, err)
+	}
+	if _, err := box1.decrypt(r); err == nil {
+		t.Fatal("decrypted with old key")
+	}
+	if r2, err := box2.rekey(r); err != nil || r2 != r {
+		t.Fatal(r2, err)
+	}
+	if _, err := newSecretBox(key2).decrypt(s); err == nil {
+		t.Fatal("decrypted with unknown key")
+	}
+}
+
+func TestAppSecrets(t *testing.T) {
+	box := newSecretBox(bytes.Repeat([]byte{1}, 32))
+	app := &WxApp{Key: "test", AppId: "wx1", Secret: "s1", AesKey: "a1", MchKey: "m1"}
+
+	enc, err := app.encrypted(box)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isEncrypted(enc.Secret) || !isEncrypted(enc.AesKey) || !isEncrypted(enc.MchKey) || enc.ClientSecret != "" || enc.AppId != "wx1" {
+		t.Fatal(enc)
+	}
+	if app.Secret != "s1" {
+		t.Fatal("app modified")
+	}
+	err = enc.decrypt(box)
+	if err != nil || *enc != *app {
+		t.Fatal(enc, err)
+	}
+
+	// migrate plaintext app
+	changed, err := app.rekey(box)
+	if err != nil || !changed || !isEncrypted(app.Secret) {
+		t.Fatal(app, err)
+	}
+	if changed, _ = app.rekey(box); changed {
+		t.Fatal("rekey again")
+	}
+}
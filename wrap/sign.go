@@ -0,0 +1,147 @@
+package wrap
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	signTimeWindow  = 5 * time.Minute // max clock skew of signed request
+	signUrlLifetime = time.Hour       // max lifetime of signed url
+	signMaxBody     = 32 << 20        // max body size of signed request
+)
+
+// paths that browsers visit directly, they may use signed url with x_expires.
+var browserPaths = []string{"/auth", "/pay/js", "/js/"}
+
+var (
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrSignExpired  = errors.New("signature expired")
+	ErrBodyTooLarge = errors.New("request body too large")
+)
+
+func (app *WxApp) setAllowIps(ips []string) {
+	app.AllowIps = strings.Join(ips, "|")
+}
+
+// ip or cidr in allow list
+func (app *WxApp) isAllowedIp(ip string) bool {
+	addr := net.ParseIP(ip)
+	if app.AllowIps == "" || addr == nil {
+		return false
+	}
+	for _, v := range strings.Split(app.AllowIps, "|") {
+		if _, n, err := net.ParseCIDR(v); err == nil {
+			if n.Contains(addr) {
+				return true
+			}
+		} else if addr.Equal(net.ParseIP(v)) {
+			return true
+		}
+	}
+	return false
+}
+
+// check request from allowed ip or signed by client secret.
+// apps without client secret only accept allowed ips, unless they are explicitly unsigned.
+// /msg is checked by the message server with signature of wechat and token of the app,
+// and calls of the app's own messages are served in process, they are not checked again.
+func (app *WxApp) verifyRequest(r *http.Request, path string) (err error) {
+	if app.Unsigned || strings.HasPrefix(path, "/msg") {
+		return
+	}
+	if parent := requestApp(r); parent != nil && parent.Key == app.Key {
+		return
+	}
+	host, _, e := net.SplitHostPort(r.RemoteAddr)
+	if e == nil && app.isAllowedIp(host) {
+		return
+	}
+
+	q := r.URL.Query()
+	sign := q.Get("x_sign")
+	if sign == "" || app.ClientSecret == "" {
+		err = ErrUnauthorized
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, signMaxBody+1))
+	if err != nil {
+		return
+	}
+	if len(body) > signMaxBody {
+		err = ErrBodyTooLarge
+		return
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	expected := signRequest(app.ClientSecret, r.URL.Path, q, body)
+	if !hmac.Equal([]byte(strings.ToLower(sign)), []byte(expected)) {
+		err = ErrUnauthorized
+		return
+	}
+
+	now := time.Now()
+	if v := q.Get("x_expires"); v != "" && isBrowserPath(path) {
+		expires, _ := strconv.ParseInt(v, 10, 64)
+		t := time.Unix(expires, 0)
+		if t.Before(now) || t.After(now.Add(signUrlLifetime)) {
+			err = ErrSignExpired
+		}
+		return
+	}
+	ts, _ := strconv.ParseInt(q.Get("x_ts"), 10, 64)
+	d := now.Sub(time.Unix(ts, 0))
+	if d > signTimeWindow || d < -signTimeWindow {
+		err = ErrSignExpired
+	}
+	return
+}
+
+// hex of HMAC-SHA256(secret, path + "?" + sorted query without x_sign),
+// followed by "\n" + hex of SHA256(body) if body is not empty.
+func signRequest(secret, path string, query url.Values, body []byte) string {
+	q := url.Values{}
+	for k, v := range query {
+		if k != "x_sign" {
+			q[k] = v
+		}
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(path + "?" + q.Encode()))
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		mac.Write([]byte("\n" + hex.EncodeToString(sum[:])))
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// remove signature parameters before proxy
+func stripSign(r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("x_sign") == "" {
+		return
+	}
+	q.Del("x_sign")
+	q.Del("x_ts")
+	q.Del("x_expires")
+	r.URL.RawQuery = q.Encode()
+}
+
+func isBrowserPath(path string) bool {
+	for _, v := range browserPaths {
+		if strings.HasPrefix(path, v) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,113 @@
+package wrap
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func signedUrl(secret, path string, q url.Values) string {
+	q.Set("x_sign", signRequest(secret, path, q, nil))
+	return path + "?" + q.Encode()
+}
+
+func TestVerifyRequest(t *testing.T) {
+	app := &WxApp{Key: "test", ClientSecret: "secret", AllowIps: "10.0.0.1|192.168.1.0/24"}
+	now := time.Now().Unix()
+	ts := strconv.FormatInt(now, 10)
+	old := strconv.FormatInt(now-3600, 10)
+	expires := strconv.FormatInt(now+600, 10)
+
+	ts_data := []struct {
+		Url    string
+		Remote string
+		Ok     bool
+	}{
+		{"/app/test/api", "1.2.3.4:1000", false},
+		{"/app/test/api", "10.0.0.1:1000", true},
+		{"/app/test/api", "192.168.1.20:1000", true},
+		{"/app/test/msg?signature=abc", "1.2.3.4:1000", true},
+		{signedUrl("secret", "/app/test/api", url.Values{"x_ts": {ts}}), "1.2.3.4:1000", true},
+		{signedUrl("secret", "/app/test/api", url.Values{"x_ts": {old}}), "1.2.3.4:1000", false},
+		{signedUrl("wrong", "/app/test/api", url.Values{"x_ts": {ts}}), "1.2.3.4:1000", false},
+		{signedUrl("secret", "/app/test/api", url.Values{"x_ts": {ts}}) + "&a=1", "1.2.3.4:1000", false},
+		{signedUrl("secret", "/app/test/auth", url.Values{"x_expires": {expires}, "call": {"/x"}}), "1.2.3.4:1000", true},
+		{signedUrl("secret", "/app/test/api", url.Values{"x_expires": {expires}}), "1.2.3.4:1000", false},
+	}
+	for _, v := range ts_data {
+		r := httptest.NewRequest("GET", v.Url, nil)
+		r.RemoteAddr = v.Remote
+		path := r.URL.Path[len("/app/test"):]
+		err := app.verifyRequest(r, path)
+		if (err == nil) != v.Ok {
+			t.Fatal(v, err)
+		}
+	}
+
+	// body is signed
+	q := url.Values{"x_ts": {ts}}
+	q.Set("x_sign", signRequest("secret", "/app/test/broadcast", q, []byte(`{"a":1}`)))
+	signed := "/app/test/broadcast?" + q.Encode()
+	body_data := []struct {
+		Body string
+		Ok   bool
+	}{
+		{`{"a":1}`, true},
+		{`{"a":2}`, false},
+		{"", false},
+	}
+	for _, v := range body_data {
+		r := httptest.NewRequest("POST", signed, strings.NewReader(v.Body))
+		r.RemoteAddr = "1.2.3.4:1000"
+		err := app.verifyRequest(r, "/broadcast")
+		if (err == nil) != v.Ok {
+			t.Fatal(v, err)
+		}
+		// body is kept for the proxied api
+		if b, _ := ioutil.ReadAll(r.Body); string(b) != v.Body {
+			t.Fatal(string(b))
+		}
+	}
+	if len(signRequest("secret", "/app/test/api", url.Values{}, nil)) != 64 {
+		t.Fatal("signature length")
+	}
+
+	// apps without client secret only accept allowed ips, unless they are unsigned
+	r := httptest.NewRequest("GET", "/app/test/api", nil)
+	r.RemoteAddr = "1.2.3.4:1000"
+	if err := (&WxApp{}).verifyRequest(r, "/api"); err != ErrUnauthorized {
+		t.Fatal(err)
+	}
+	r = httptest.NewRequest("GET", signedUrl("", "/app/test/api", url.Values{"x_ts": {ts}}), nil)
+	r.RemoteAddr = "1.2.3.4:1000"
+	if err := (&WxApp{}).verifyRequest(r, "/api"); err != ErrUnauthorized {
+		t.Fatal(err)
+	}
+	if err := (&WxApp{AllowIps: "1.2.3.4"}).verifyRequest(r, "/api"); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&WxApp{Unsigned: true}).verifyRequest(r, "/api"); err != nil {
+		t.Fatal(err)
+	}
+
+	// calls of messages of the same app are served in process
+	r = httptest.NewRequest("POST", "/app/test/user", nil)
+	if err := app.verifyRequest(withApp(r, app), "/user"); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.verifyRequest(withApp(r, &WxApp{Key: "other"}), "/user"); err == nil {
+		t.Fatal("call of other app accepted")
+	}
+}
+
+func TestStripSign(t *testing.T) {
+	r := httptest.NewRequest("GET", "/app/test/api?a=1&x_ts=1&x_sign=abc", nil)
+	stripSign(r)
+	if r.URL.RawQuery != "a=1" {
+		t.Fatal(r.URL.RawQuery)
+	}
+}
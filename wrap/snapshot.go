@@ -0,0 +1,186 @@
+package wrap
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const snapshotDefaultInterval = time.Minute
+
+// registrations and users of memory storage, saved as json file.
+type memorySnapshot struct {
+	Time     int64
+	Apps     []*WxApp
+	Tenants  []*WxTenant
+	Webhooks []*WxWebhook
+	Users    []*WxUser
+}
+
+// open memory storage with snapshot file:
+//
+//	memory://wxproxy.json?interval=60
+func openMemoryStorage(args string) (s *memoryStorage, err error) {
+	path, query := args, ""
+	if i := strings.Index(args, "?"); i >= 0 {
+		path, query = args[:i], args[i+1:]
+	}
+	q, err := url.ParseQuery(query)
+	if err != nil {
+		return
+	}
+	interval := snapshotDefaultInterval
+	if v := q.Get("interval"); v != "" {
+		var n int
+		n, err = strconv.Atoi(v)
+		if err != nil {
+			return
+		}
+		interval = time.Duration(n) * time.Second
+	}
+
+	s = newMemoryStorage()
+	s.snapshotPath = path
+	err = s.loadSnapshot()
+	if err != nil {
+		return
+	}
+	if interval > 0 {
+		s.snapshotStop = make(chan bool)
+		go s.snapshotLoop(interval, s.snapshotStop)
+	}
+	return
+}
+
+// mark registrations or users changed
+func (s *memoryStorage) touch() {
+	atomic.StoreInt32(&s.dirty, 1)
+}
+
+func (s *memoryStorage) snapshotLoop(interval time.Duration, stop chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			err := s.saveSnapshot()
+			if err != nil {
+				log.Println(err.Error())
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (s *memoryStorage) loadSnapshot() (err error) {
+	data, err := ioutil.ReadFile(s.snapshotPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return
+	}
+	var snap memorySnapshot
+	err = json.Unmarshal(data, &snap)
+	if err != nil {
+		return
+	}
+
+	box, err := secrets()
+	if err != nil {
+		return
+	}
+	for _, app := range snap.Apps {
+		err = app.decrypt(box)
+		if err != nil {
+			return
+		}
+		s.SaveApp(app)
+	}
+	for _, t := range snap.Tenants {
+		s.SaveTenant(t)
+	}
+	for _, h := range snap.Webhooks {
+		s.SaveWebhook(h)
+	}
+	for _, u := range snap.Users {
+		s.SaveUser(u)
+	}
+	atomic.StoreInt32(&s.dirty, 0)
+	return
+}
+
+// write snapshot if changed, file is replaced by atomic rename.
+func (s *memoryStorage) saveSnapshot() (err error) {
+	s.snapshotLock.Lock()
+	defer s.snapshotLock.Unlock()
+	if s.snapshotPath == "" || atomic.SwapInt32(&s.dirty, 0) == 0 {
+		return
+	}
+	defer func() {
+		if err != nil {
+			s.touch()
+		}
+	}()
+
+	box, err := secrets()
+	if err != nil {
+		return
+	}
+	snap := &memorySnapshot{Time: time.Now().Unix()}
+	s.appMap.Range(func(key string, value interface{}) bool {
+		app := value.(WxApp)
+		var enc *WxApp
+		enc, err = app.encrypted(box)
+		snap.Apps = append(snap.Apps, enc)
+		return err == nil
+	})
+	if err != nil {
+		return
+	}
+	s.tenantMap.Range(func(key string, value interface{}) bool {
+		t := value.(WxTenant)
+		snap.Tenants = append(snap.Tenants, &t)
+		return true
+	})
+	s.webhookMap.Range(func(key string, value interface{}) bool {
+		h := value.(WxWebhook)
+		snap.Webhooks = append(snap.Webhooks, &h)
+		return true
+	})
+	s.userMap.Range(func(key string, value interface{}) bool {
+		u := value.(WxUser)
+		snap.Users = append(snap.Users, &u)
+		return true
+	})
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.snapshotPath), filepath.Base(s.snapshotPath)+".tmp")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return
+	}
+	err = os.Rename(tmp.Name(), s.snapshotPath)
+	return
+}
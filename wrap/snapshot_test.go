@@ -0,0 +1,80 @@
+package wrap
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMemorySnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wxproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "wxproxy.json")
+
+	s, err := OpenStorage("memory://" + path + "?interval=0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SaveApp(&WxApp{Key: "test", AppId: "wx1", Secret: "s1", Owner: "t1"})
+	s.SaveTenant(&WxTenant{ApiKey: "h1", Name: "t1"})
+	s.SaveWebhook(&WxWebhook{AppId: "wx1", Url: "https://example.com/hook", Secret: "k"})
+	s.SaveUser(&WxUser{AppId: "wx1", OpenId: "o1", Nickname: "alice", Tags: ",2,"})
+	s.SaveTemplate(&WxTemplate{AppId: "wx1", Alias: "order"})
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = OpenStorage("memory://" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if app, err := s.LoadApp("test"); err != nil || app.Secret != "s1" || app.Owner != "t1" {
+		t.Fatal(app, err)
+	}
+	if tenant, err := s.LoadTenant("h1"); err != nil || tenant.Name != "t1" {
+		t.Fatal(tenant, err)
+	}
+	if hooks, err := s.LoadWebhooks("wx1"); err != nil || len(hooks) != 1 {
+		t.Fatal(hooks, err)
+	}
+	if u, err := s.LoadUser("wx1", "o1"); err != nil || u.Nickname != "alice" || u.Tags != ",2," {
+		t.Fatal(u, err)
+	}
+	if _, err := s.LoadTemplate("wx1", "order"); err != ErrNotFound {
+		t.Fatal("template should not be in snapshot")
+	}
+}
+
+func TestMemorySnapshotDirty(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wxproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := newMemoryStorage()
+	s.snapshotPath = filepath.Join(dir, "wxproxy.json")
+	s.SaveApp(&WxApp{Key: "test", AppId: "wx1", Secret: "plain-secret"})
+	if err := s.saveSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(s.snapshotPath)
+	if err != nil || !bytes.Contains(data, []byte("wx1")) {
+		t.Fatal(string(data), err)
+	}
+
+	// unchanged storage is not written again
+	os.Remove(s.snapshotPath)
+	if err := s.saveSnapshot(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(s.snapshotPath); !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+}
@@ -1,63 +1,167 @@
-// +build !sqlite
-
 package wrap
 
 import (
 	"time"
 	wx "wechat-proxy/wechat"
 	"fmt"
-	"errors"
+	"sort"
+	"sync"
 )
 
-const (
-	storeCacheDuration = 365 * 24 * time.Hour
-	storeCacheLimit    = 1000
-)
+const storeCacheDuration = 365 * 24 * time.Hour
+
+// max count of each kind of history records (events, locations, template messages, broadcasts) in memory storage,
+// the oldest records are dropped when it is exceeded.
+var StoreCacheLimit = 1000
+
+type memoryStorage struct {
+	appMap *memoryTable
+	userMap *memoryTable
+	templateMap *wx.CacheMap
+	templateMsgMap *wx.CacheMap
+	broadcastMap *wx.CacheMap
+	broadcastBatchMap *wx.CacheMap
+	menuMap *wx.CacheMap
+	sceneMap *wx.CacheMap
+	eventMap *wx.CacheMap
+	locationMap *wx.CacheMap
+	webhookMap *memoryTable
+	tenantMap *memoryTable
+
+	snapshotPath string    // snapshot file, empty means no snapshot
+	snapshotStop chan bool // stop periodic snapshot
+	snapshotLock sync.Mutex
+	dirty        int32     // registrations or users changed since last snapshot
+}
+
+// registry without expiration or limit, items stay until removed.
+type memoryTable struct {
+	m    map[string]interface{}
+	lock sync.RWMutex
+}
+
+func newMemoryTable() *memoryTable {
+	t := new(memoryTable)
+	t.m = make(map[string]interface{})
+	return t
+}
 
-var storage *Storage
+func (t *memoryTable) Set(key string, value interface{}) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.m[key] = value
+}
 
-type Storage struct {
-	appMap *wx.CacheMap
-	userMap *wx.CacheMap
+func (t *memoryTable) Get(key string) (value interface{}, ok bool) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	value, ok = t.m[key]
+	return
 }
 
-func NewStorage() *Storage {
-	if storage == nil {
-		s := new(Storage)
-		s.appMap = wx.NewCacheMap(storeCacheDuration, storeCacheLimit)
-		s.userMap = wx.NewCacheMap(storeCacheDuration, storeCacheLimit)
-		storage = s
+func (t *memoryTable) Remove(key string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.m, key)
+}
+
+// Range calls f for each item, stop when f returns false.
+func (t *memoryTable) Range(f func(key string, value interface{}) bool) {
+	t.lock.RLock()
+	items := make(map[string]interface{}, len(t.m))
+	for k, v := range t.m {
+		items[k] = v
+	}
+	t.lock.RUnlock()
+
+	for k, v := range items {
+		if !f(k, v) {
+			return
+		}
 	}
-	return storage
 }
 
-func (s *Storage) SaveApp(app *WxApp) (err error) {
+func newMemoryStorage() *memoryStorage {
+	s := new(memoryStorage)
+	s.appMap = newMemoryTable()
+	s.userMap = newMemoryTable()
+	s.templateMap = wx.NewCacheMap(storeCacheDuration, StoreCacheLimit)
+	s.templateMsgMap = wx.NewCacheMap(storeCacheDuration, StoreCacheLimit)
+	s.broadcastMap = wx.NewCacheMap(storeCacheDuration, StoreCacheLimit)
+	s.broadcastBatchMap = wx.NewCacheMap(storeCacheDuration, StoreCacheLimit)
+	s.menuMap = wx.NewCacheMap(storeCacheDuration, StoreCacheLimit)
+	s.sceneMap = wx.NewCacheMap(storeCacheDuration, StoreCacheLimit)
+	s.eventMap = wx.NewCacheMap(storeCacheDuration, StoreCacheLimit)
+	s.locationMap = wx.NewCacheMap(storeCacheDuration, StoreCacheLimit)
+	wx.TrackCache("store_template", s.templateMap)
+	wx.TrackCache("store_template_msg", s.templateMsgMap)
+	wx.TrackCache("store_broadcast", s.broadcastMap)
+	wx.TrackCache("store_broadcast_batch", s.broadcastBatchMap)
+	wx.TrackCache("store_menu", s.menuMap)
+	wx.TrackCache("store_scene", s.sceneMap)
+	wx.TrackCache("store_event", s.eventMap)
+	wx.TrackCache("store_location", s.locationMap)
+	s.webhookMap = newMemoryTable()
+	s.tenantMap = newMemoryTable()
+	return s
+}
+
+func (s *memoryStorage) SaveApp(app *WxApp) (err error) {
+	defer s.touch()
+	// expired apps are kept, they can be renewed
 	s.appMap.Set(app.Key, *app)
-	s.appMap.Shrink()
 	return
 }
 
-func (s *Storage) LoadApp(key string) (app *WxApp, err error) {
+func (s *memoryStorage) LoadApp(key string) (app *WxApp, err error) {
 	v, ok := s.appMap.Get(key)
 	if !ok {
 		err = ErrNotFound
 		return
 	}
 	r := v.(WxApp)
+	app = &r
 	if r.isExpired() {
+		err = ErrExpired
+	}
+	return
+}
+
+func (s *memoryStorage) LoadApps() (apps []*WxApp, err error) {
+	s.appMap.Range(func(key string, value interface{}) bool {
+		r := value.(WxApp)
+		apps = append(apps, &r)
+		return true
+	})
+	sort.Slice(apps, func(i, j int) bool {
+		return apps[i].Key < apps[j].Key
+	})
+	return
+}
+
+// secrets are not stored at rest in memory storage
+func (s *memoryStorage) RekeyApps() (n int, err error) {
+	return
+}
+
+func (s *memoryStorage) DeleteApp(key string) (err error) {
+	defer s.touch()
+	if _, ok := s.appMap.Get(key); !ok {
+		err = ErrNotFound
 		return
 	}
-	app = &r
+	s.appMap.Remove(key)
 	return
 }
 
-func (s *Storage) SaveUser(user *WxUser) (err error) {
+func (s *memoryStorage) SaveUser(user *WxUser) (err error) {
+	defer s.touch()
 	key := fmt.Sprintf("%s-%s", user.AppId, user.OpenId)
 	s.userMap.Set(key, *user)
 	return
 }
 
-func (s *Storage) LoadUser(appid, openid string) (user *WxUser, err error) {
+func (s *memoryStorage) LoadUser(appid, openid string) (user *WxUser, err error) {
 	key := fmt.Sprintf("%s-%s", appid, openid)
 	v, ok := s.userMap.Get(key)
 	if !ok {
@@ -69,4 +173,327 @@ func (s *Storage) LoadUser(appid, openid string) (user *WxUser, err error) {
 	return
 }
 
-var ErrNotFound = errors.New("not found")
+func (s *memoryStorage) LoadUsers(appid string) (users []*WxUser, err error) {
+	s.userMap.Range(func(key string, value interface{}) bool {
+		r := value.(WxUser)
+		if r.AppId == appid {
+			users = append(users, &r)
+		}
+		return true
+	})
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].OpenId < users[j].OpenId
+	})
+	return
+}
+
+func (s *memoryStorage) LoadUnionUsers(unionid string) (users []*WxUser, err error) {
+	s.userMap.Range(func(key string, value interface{}) bool {
+		r := value.(WxUser)
+		if r.UnionId == unionid {
+			users = append(users, &r)
+		}
+		return true
+	})
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].AppId < users[j].AppId
+	})
+	return
+}
+
+func (s *memoryStorage) QueryUsers(q *UserQuery) (users []*WxUser, total int, err error) {
+	all, err := s.LoadUsers(q.AppId)
+	if err != nil {
+		return
+	}
+	users, total = q.apply(all)
+	return
+}
+
+func (s *memoryStorage) SaveUserEvent(e *WxUserEvent) (err error) {
+	key := fmt.Sprintf("%s-%s-%d-%s", e.AppId, e.OpenId, e.CreateTime, e.Event)
+	s.eventMap.Set(key, *e)
+	s.eventMap.Shrink()
+	return
+}
+
+func (s *memoryStorage) LoadUserEvents(appid string, begin, end uint64) (events []*WxUserEvent, err error) {
+	s.eventMap.Range(func(key string, value interface{}) bool {
+		r := value.(WxUserEvent)
+		if r.AppId == appid && r.CreateTime >= begin && r.CreateTime < end {
+			events = append(events, &r)
+		}
+		return true
+	})
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].CreateTime < events[j].CreateTime
+	})
+	return
+}
+
+// location history is limited by StoreCacheLimit and not saved to snapshot, it is lost on restart.
+func (s *memoryStorage) SaveLocation(l *WxLocation) (err error) {
+	key := fmt.Sprintf("%s-%s-%d", l.AppId, l.OpenId, l.CreateTime)
+	s.locationMap.Set(key, *l)
+	s.locationMap.Shrink()
+	return
+}
+
+func (s *memoryStorage) LoadLocations(appid, openid string, begin, end uint64) (ls []*WxLocation, err error) {
+	s.locationMap.Range(func(key string, value interface{}) bool {
+		r := value.(WxLocation)
+		if r.AppId == appid && r.OpenId == openid && r.CreateTime >= begin && r.CreateTime < end {
+			ls = append(ls, &r)
+		}
+		return true
+	})
+	sort.Slice(ls, func(i, j int) bool {
+		return ls[i].CreateTime < ls[j].CreateTime
+	})
+	return
+}
+
+func (s *memoryStorage) SaveTemplate(t *WxTemplate) (err error) {
+	key := fmt.Sprintf("%s-%s", t.AppId, t.Alias)
+	s.templateMap.Set(key, *t)
+	return
+}
+
+func (s *memoryStorage) LoadTemplate(appid, alias string) (t *WxTemplate, err error) {
+	key := fmt.Sprintf("%s-%s", appid, alias)
+	v, ok := s.templateMap.Get(key)
+	if !ok {
+		err = ErrNotFound
+		return
+	}
+	r := v.(WxTemplate)
+	t = &r
+	return
+}
+
+func (s *memoryStorage) LoadTemplates(appid string) (ts []*WxTemplate, err error) {
+	s.templateMap.Range(func(key string, value interface{}) bool {
+		r := value.(WxTemplate)
+		if r.AppId == appid {
+			ts = append(ts, &r)
+		}
+		return true
+	})
+	sort.Slice(ts, func(i, j int) bool {
+		return ts[i].Alias < ts[j].Alias
+	})
+	return
+}
+
+func (s *memoryStorage) SaveTemplateMsg(m *WxTemplateMsg) (err error) {
+	key := fmt.Sprintf("%s-%d", m.AppId, m.MsgId)
+	s.templateMsgMap.Set(key, *m)
+	s.templateMsgMap.Shrink()
+	return
+}
+
+func (s *memoryStorage) LoadTemplateMsg(appid string, msgid uint64) (m *WxTemplateMsg, err error) {
+	key := fmt.Sprintf("%s-%d", appid, msgid)
+	v, ok := s.templateMsgMap.Get(key)
+	if !ok {
+		err = ErrNotFound
+		return
+	}
+	r := v.(WxTemplateMsg)
+	m = &r
+	return
+}
+
+func (s *memoryStorage) SaveBroadcast(b *WxBroadcast) (err error) {
+	key := fmt.Sprintf("%s-%s", b.AppId, b.JobId)
+	s.broadcastMap.Set(key, *b)
+	s.broadcastMap.Shrink()
+	return
+}
+
+func (s *memoryStorage) LoadBroadcast(appid, jobid string) (b *WxBroadcast, err error) {
+	key := fmt.Sprintf("%s-%s", appid, jobid)
+	v, ok := s.broadcastMap.Get(key)
+	if !ok {
+		err = ErrNotFound
+		return
+	}
+	r := v.(WxBroadcast)
+	b = &r
+	return
+}
+
+func (s *memoryStorage) SaveBroadcastBatch(b *WxBroadcastBatch) (err error) {
+	key := fmt.Sprintf("%s-%d", b.AppId, b.MsgId)
+	s.broadcastBatchMap.Set(key, *b)
+	s.broadcastBatchMap.Shrink()
+	return
+}
+
+func (s *memoryStorage) LoadBroadcastBatch(appid string, msgid uint64) (b *WxBroadcastBatch, err error) {
+	key := fmt.Sprintf("%s-%d", appid, msgid)
+	v, ok := s.broadcastBatchMap.Get(key)
+	if !ok {
+		err = ErrNotFound
+		return
+	}
+	r := v.(WxBroadcastBatch)
+	b = &r
+	return
+}
+
+func (s *memoryStorage) LoadBroadcastBatches(appid, jobid string) (bs []*WxBroadcastBatch, err error) {
+	s.broadcastBatchMap.Range(func(key string, value interface{}) bool {
+		r := value.(WxBroadcastBatch)
+		if r.AppId == appid && r.JobId == jobid {
+			bs = append(bs, &r)
+		}
+		return true
+	})
+	sort.Slice(bs, func(i, j int) bool {
+		return bs[i].MsgId < bs[j].MsgId
+	})
+	return
+}
+
+func (s *memoryStorage) SaveMenu(m *WxMenu) (err error) {
+	key := fmt.Sprintf("%s-%d", m.AppId, m.Version)
+	s.menuMap.Set(key, *m)
+	return
+}
+
+func (s *memoryStorage) LoadMenu(appid string, version int) (m *WxMenu, err error) {
+	key := fmt.Sprintf("%s-%d", appid, version)
+	v, ok := s.menuMap.Get(key)
+	if !ok {
+		err = ErrNotFound
+		return
+	}
+	r := v.(WxMenu)
+	m = &r
+	return
+}
+
+func (s *memoryStorage) LoadMenus(appid string) (ms []*WxMenu, err error) {
+	s.menuMap.Range(func(key string, value interface{}) bool {
+		r := value.(WxMenu)
+		if r.AppId == appid {
+			ms = append(ms, &r)
+		}
+		return true
+	})
+	sort.Slice(ms, func(i, j int) bool {
+		return ms[i].Version < ms[j].Version
+	})
+	return
+}
+
+func (s *memoryStorage) SaveScene(scene *WxScene) (err error) {
+	key := fmt.Sprintf("%s-%s", scene.AppId, scene.Scene)
+	s.sceneMap.Set(key, *scene)
+	return
+}
+
+func (s *memoryStorage) LoadScene(appid, scene string) (r *WxScene, err error) {
+	key := fmt.Sprintf("%s-%s", appid, scene)
+	v, ok := s.sceneMap.Get(key)
+	if !ok {
+		err = ErrNotFound
+		return
+	}
+	x := v.(WxScene)
+	r = &x
+	return
+}
+
+func (s *memoryStorage) LoadScenes(appid string) (scenes []*WxScene, err error) {
+	s.sceneMap.Range(func(key string, value interface{}) bool {
+		r := value.(WxScene)
+		if r.AppId == appid {
+			scenes = append(scenes, &r)
+		}
+		return true
+	})
+	sort.Slice(scenes, func(i, j int) bool {
+		return scenes[i].Scene < scenes[j].Scene
+	})
+	return
+}
+
+func (s *memoryStorage) SaveWebhook(h *WxWebhook) (err error) {
+	defer s.touch()
+	key := fmt.Sprintf("%s-%s", h.AppId, h.Url)
+	s.webhookMap.Set(key, *h)
+	return
+}
+
+func (s *memoryStorage) LoadWebhooks(appid string) (hooks []*WxWebhook, err error) {
+	s.webhookMap.Range(func(key string, value interface{}) bool {
+		r := value.(WxWebhook)
+		if r.AppId == appid {
+			hooks = append(hooks, &r)
+		}
+		return true
+	})
+	sort.Slice(hooks, func(i, j int) bool {
+		return hooks[i].Url < hooks[j].Url
+	})
+	return
+}
+
+func (s *memoryStorage) DeleteWebhook(appid, url string) (err error) {
+	defer s.touch()
+	key := fmt.Sprintf("%s-%s", appid, url)
+	if _, ok := s.webhookMap.Get(key); !ok {
+		err = ErrNotFound
+		return
+	}
+	s.webhookMap.Remove(key)
+	return
+}
+
+func (s *memoryStorage) SaveTenant(t *WxTenant) (err error) {
+	defer s.touch()
+	s.tenantMap.Set(t.ApiKey, *t)
+	return
+}
+
+func (s *memoryStorage) LoadTenant(apiKey string) (t *WxTenant, err error) {
+	v, ok := s.tenantMap.Get(apiKey)
+	if !ok {
+		err = ErrNotFound
+		return
+	}
+	r := v.(WxTenant)
+	t = &r
+	return
+}
+
+func (s *memoryStorage) DeleteTenant(name string) (err error) {
+	defer s.touch()
+	var keys []string
+	s.tenantMap.Range(func(key string, value interface{}) bool {
+		if value.(WxTenant).Name == name {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	if len(keys) == 0 {
+		err = ErrNotFound
+		return
+	}
+	for _, key := range keys {
+		s.tenantMap.Remove(key)
+	}
+	return
+}
+
+// stop periodic snapshot and flush
+func (s *memoryStorage) Close() (err error) {
+	if s.snapshotStop != nil {
+		close(s.snapshotStop)
+		s.snapshotStop = nil
+	}
+	err = s.saveSnapshot()
+	return
+}
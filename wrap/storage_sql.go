@@ -0,0 +1,516 @@
+package wrap
+
+import (
+	"fmt"
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/mysql"
+	_ "github.com/jinzhu/gorm/dialects/postgres"
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+	"strings"
+	"time"
+	wx "wechat-proxy/wechat"
+)
+
+const (
+	// wait for locked database instead of failing, WAL allows reading while writing.
+	sqliteArgs = "_busy_timeout=5000&_journal_mode=WAL"
+
+	dbMaxOpenConns = 8
+	dbMaxIdleConns = 4
+
+	appCacheDuration = time.Minute
+	appCacheLimit    = 1000
+)
+
+// storage of sqlite, postgres and mysql
+type sqlStorage struct {
+	conn     *gorm.DB
+	appCache *wx.CacheMap // decrypted WxApp by key
+}
+
+// open database and apply migrations
+func openSqlStorage(dialect, args string) (s *sqlStorage, err error) {
+	conn, err := gorm.Open(dialect, args)
+	if err != nil {
+		return
+	}
+	conn.DB().SetMaxOpenConns(dbMaxOpenConns)
+	conn.DB().SetMaxIdleConns(dbMaxIdleConns)
+	err = migrate(conn)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	s = &sqlStorage{conn: conn}
+	s.appCache = wx.NewCacheMap(appCacheDuration, appCacheLimit)
+	wx.TrackCache("store_app", s.appCache)
+	return
+}
+
+func (s *sqlStorage) Close() error {
+	return s.conn.Close()
+}
+
+// run f with shared db, gorm not found error is replaced by ErrNotFound.
+func (s *sqlStorage) db(f func(*gorm.DB) error) (err error) {
+	err = f(s.conn)
+	if gorm.IsRecordNotFoundError(err) {
+		err = ErrNotFound
+	}
+	return
+}
+
+type schemaVersion struct {
+	Version    int    `gorm:"column:version; primary_key"`
+	CreateTime uint64 `gorm:"column:create_time"`
+}
+
+func (schemaVersion) TableName() string {
+	return "schema_version"
+}
+
+// schema migrations, append only. version N is migrations[N-1].
+var migrations = []func(db *gorm.DB) error{
+	// 1: tables before schema versioning
+	func(db *gorm.DB) error {
+		return db.AutoMigrate(
+			&WxApp{}, &WxTenant{}, &WxUser{}, &WxUserEvent{}, &WxLocation{}, &WxWebhook{},
+			&WxTemplate{}, &WxTemplateMsg{}, &WxBroadcast{}, &WxBroadcastBatch{},
+			&WxMenu{}, &WxScene{},
+		).Error
+	},
+}
+
+// apply new migrations in order
+func migrate(db *gorm.DB) (err error) {
+	err = db.AutoMigrate(&schemaVersion{}).Error
+	if err != nil {
+		return
+	}
+	var current int
+	err = db.Model(&schemaVersion{}).Select("COALESCE(MAX(version), 0)").Row().Scan(&current)
+	if err != nil {
+		return
+	}
+	for v := current + 1; v <= len(migrations); v++ {
+		tx := db.Begin()
+		err = migrations[v-1](tx)
+		if err == nil {
+			err = tx.Create(&schemaVersion{v, uint64(time.Now().Unix())}).Error
+		}
+		if err != nil {
+			tx.Rollback()
+			err = fmt.Errorf("migration %d: %s", v, err.Error())
+			return
+		}
+		err = tx.Commit().Error
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (s *sqlStorage) SaveApp(app *WxApp) (err error) {
+	box, err := secrets()
+	if err != nil {
+		return
+	}
+	enc, err := app.encrypted(box)
+	if err != nil {
+		return
+	}
+
+	// expired apps are kept, they can be renewed
+	s.appCache.Remove(app.Key)
+	err = s.db(func(db *gorm.DB) error {
+		return db.Save(enc).Error
+	})
+	return
+}
+
+// read through cache of apps
+func (s *sqlStorage) LoadApp(key string) (app *WxApp, err error) {
+	if v, ok := s.appCache.Get(key); ok {
+		r := v.(WxApp)
+		app = &r
+		if r.isExpired() {
+			err = ErrExpired
+		}
+		return
+	}
+
+	r := WxApp{}
+	err = s.db(func(db *gorm.DB) error {
+		return db.Where(db.Dialect().Quote("key")+" = ?", key).First(&r).Error
+	})
+	if err != nil {
+		return
+	}
+	box, err := secrets()
+	if err != nil {
+		return
+	}
+	err = r.decrypt(box)
+	if err != nil {
+		return
+	}
+	s.appCache.Set(key, r)
+	s.appCache.Shrink()
+
+	app = &r
+	if r.isExpired() {
+		err = ErrExpired
+	}
+	return
+}
+
+func (s *sqlStorage) LoadApps() (apps []*WxApp, err error) {
+	box, err := secrets()
+	if err != nil {
+		return
+	}
+	err = s.db(func(db *gorm.DB) error {
+		return db.Order(db.Dialect().Quote("key")).Find(&apps).Error
+	})
+	if err != nil {
+		return
+	}
+	for _, app := range apps {
+		err = app.decrypt(box)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// encrypt plaintext secrets of apps, and rewrap them with current master key.
+func (s *sqlStorage) RekeyApps() (n int, err error) {
+	box, err := secrets()
+	if err != nil {
+		return
+	}
+	if box.current == "" {
+		err = ErrNoMasterKey
+		return
+	}
+	err = s.db(func(db *gorm.DB) error {
+		var apps []*WxApp
+		err := db.Find(&apps).Error
+		if err != nil {
+			return err
+		}
+		for _, app := range apps {
+			changed, err := app.rekey(box)
+			if err != nil {
+				return fmt.Errorf("%s: %s", app.Key, err.Error())
+			}
+			if !changed {
+				continue
+			}
+			err = db.Save(app).Error
+			if err != nil {
+				return err
+			}
+			n++
+		}
+		return nil
+	})
+	s.appCache = wx.NewCacheMap(appCacheDuration, appCacheLimit)
+	wx.TrackCache("store_app", s.appCache)
+	return
+}
+
+func (s *sqlStorage) DeleteApp(key string) (err error) {
+	s.appCache.Remove(key)
+	err = s.db(func(db *gorm.DB) error {
+		r := db.Where(db.Dialect().Quote("key")+" = ?", key).Delete(WxApp{})
+		if r.Error == nil && r.RowsAffected == 0 {
+			return ErrNotFound
+		}
+		return r.Error
+	})
+	return
+}
+
+func (s *sqlStorage) SaveUser(user *WxUser) (err error) {
+	err = s.db(func(db *gorm.DB) error {
+		return db.Save(user).Error
+	})
+	return
+}
+
+func (s *sqlStorage) LoadUser(appid, openid string) (user *WxUser, err error) {
+	err = s.db(func(db *gorm.DB) error {
+		r := WxUser{}
+		user = &r
+		return db.Where("appid = ? AND openid = ?", appid, openid).First(&r).Error
+	})
+	return
+}
+
+func (s *sqlStorage) LoadUsers(appid string) (users []*WxUser, err error) {
+	err = s.db(func(db *gorm.DB) error {
+		return db.Where("appid = ?", appid).Order("openid").Find(&users).Error
+	})
+	return
+}
+
+func (s *sqlStorage) LoadUnionUsers(unionid string) (users []*WxUser, err error) {
+	err = s.db(func(db *gorm.DB) error {
+		return db.Where("unionid = ?", unionid).Order("appid").Find(&users).Error
+	})
+	return
+}
+
+func (s *sqlStorage) QueryUsers(q *UserQuery) (users []*WxUser, total int, err error) {
+	q.normalize()
+	err = s.db(func(db *gorm.DB) error {
+		db = db.Model(&WxUser{}).Where("appid = ?", q.AppId)
+		if q.OpenId != "" {
+			db = db.Where("openid = ?", q.OpenId)
+		}
+		if q.UnionId != "" {
+			db = db.Where("unionid = ?", q.UnionId)
+		}
+		if q.Subscribe != nil {
+			db = db.Where("subscribe = ?", *q.Subscribe)
+		}
+		if q.Nickname != "" {
+			db = db.Where("nickname LIKE ?", "%"+q.Nickname+"%")
+		}
+		if q.Tag != "" {
+			db = db.Where("tags LIKE ?", "%,"+q.Tag+",%")
+		}
+		if q.Province != "" {
+			db = db.Where("province = ?", q.Province)
+		}
+		if q.City != "" {
+			db = db.Where("city = ?", q.City)
+		}
+		if q.Begin > 0 {
+			db = db.Where("subscribe_time >= ?", q.Begin)
+		}
+		if q.End > 0 {
+			db = db.Where("subscribe_time < ?", q.End)
+		}
+		err := db.Count(&total).Error
+		if err != nil {
+			return err
+		}
+
+		order := q.Sort
+		if strings.HasPrefix(order, "-") {
+			order = strings.TrimPrefix(order, "-") + " DESC"
+		}
+		return db.Order(order).Order("openid").Offset(q.Offset).Limit(q.Limit).Find(&users).Error
+	})
+	return
+}
+
+func (s *sqlStorage) SaveUserEvent(e *WxUserEvent) (err error) {
+	err = s.db(func(db *gorm.DB) error {
+		return db.Create(e).Error
+	})
+	return
+}
+
+func (s *sqlStorage) LoadUserEvents(appid string, begin, end uint64) (events []*WxUserEvent, err error) {
+	err = s.db(func(db *gorm.DB) error {
+		return db.Where("appid = ? AND create_time >= ? AND create_time < ?", appid, begin, end).
+			Order("create_time").Find(&events).Error
+	})
+	return
+}
+
+func (s *sqlStorage) SaveLocation(l *WxLocation) (err error) {
+	err = s.db(func(db *gorm.DB) error {
+		return db.Create(l).Error
+	})
+	return
+}
+
+func (s *sqlStorage) LoadLocations(appid, openid string, begin, end uint64) (ls []*WxLocation, err error) {
+	err = s.db(func(db *gorm.DB) error {
+		return db.Where("appid = ? AND openid = ? AND create_time >= ? AND create_time < ?", appid, openid, begin, end).
+			Order("create_time").Find(&ls).Error
+	})
+	return
+}
+
+func (s *sqlStorage) SaveTemplate(t *WxTemplate) (err error) {
+	err = s.db(func(db *gorm.DB) error {
+		return db.Save(t).Error
+	})
+	return
+}
+
+func (s *sqlStorage) LoadTemplate(appid, alias string) (t *WxTemplate, err error) {
+	err = s.db(func(db *gorm.DB) error {
+		r := WxTemplate{}
+		t = &r
+		return db.Where("appid = ? AND alias = ?", appid, alias).First(&r).Error
+	})
+	return
+}
+
+func (s *sqlStorage) LoadTemplates(appid string) (ts []*WxTemplate, err error) {
+	err = s.db(func(db *gorm.DB) error {
+		return db.Where("appid = ?", appid).Order("alias").Find(&ts).Error
+	})
+	return
+}
+
+func (s *sqlStorage) SaveTemplateMsg(m *WxTemplateMsg) (err error) {
+	err = s.db(func(db *gorm.DB) error {
+		return db.Save(m).Error
+	})
+	return
+}
+
+func (s *sqlStorage) LoadTemplateMsg(appid string, msgid uint64) (m *WxTemplateMsg, err error) {
+	err = s.db(func(db *gorm.DB) error {
+		r := WxTemplateMsg{}
+		m = &r
+		return db.Where("appid = ? AND msgid = ?", appid, msgid).First(&r).Error
+	})
+	return
+}
+
+func (s *sqlStorage) SaveBroadcast(b *WxBroadcast) (err error) {
+	err = s.db(func(db *gorm.DB) error {
+		return db.Save(b).Error
+	})
+	return
+}
+
+func (s *sqlStorage) LoadBroadcast(appid, jobid string) (b *WxBroadcast, err error) {
+	err = s.db(func(db *gorm.DB) error {
+		r := WxBroadcast{}
+		b = &r
+		return db.Where("appid = ? AND job_id = ?", appid, jobid).First(&r).Error
+	})
+	return
+}
+
+func (s *sqlStorage) SaveBroadcastBatch(b *WxBroadcastBatch) (err error) {
+	err = s.db(func(db *gorm.DB) error {
+		return db.Save(b).Error
+	})
+	return
+}
+
+func (s *sqlStorage) LoadBroadcastBatch(appid string, msgid uint64) (b *WxBroadcastBatch, err error) {
+	err = s.db(func(db *gorm.DB) error {
+		r := WxBroadcastBatch{}
+		b = &r
+		return db.Where("appid = ? AND msgid = ?", appid, msgid).First(&r).Error
+	})
+	return
+}
+
+func (s *sqlStorage) LoadBroadcastBatches(appid, jobid string) (bs []*WxBroadcastBatch, err error) {
+	err = s.db(func(db *gorm.DB) error {
+		return db.Where("appid = ? AND job_id = ?", appid, jobid).Order("msgid").Find(&bs).Error
+	})
+	return
+}
+
+func (s *sqlStorage) SaveMenu(m *WxMenu) (err error) {
+	err = s.db(func(db *gorm.DB) error {
+		return db.Save(m).Error
+	})
+	return
+}
+
+func (s *sqlStorage) LoadMenu(appid string, version int) (m *WxMenu, err error) {
+	err = s.db(func(db *gorm.DB) error {
+		r := WxMenu{}
+		m = &r
+		return db.Where("appid = ? AND version = ?", appid, version).First(&r).Error
+	})
+	return
+}
+
+func (s *sqlStorage) LoadMenus(appid string) (ms []*WxMenu, err error) {
+	err = s.db(func(db *gorm.DB) error {
+		return db.Where("appid = ?", appid).Order("version").Find(&ms).Error
+	})
+	return
+}
+
+func (s *sqlStorage) SaveScene(scene *WxScene) (err error) {
+	err = s.db(func(db *gorm.DB) error {
+		return db.Save(scene).Error
+	})
+	return
+}
+
+func (s *sqlStorage) LoadScene(appid, scene string) (r *WxScene, err error) {
+	err = s.db(func(db *gorm.DB) error {
+		x := WxScene{}
+		r = &x
+		return db.Where("appid = ? AND scene = ?", appid, scene).First(&x).Error
+	})
+	return
+}
+
+func (s *sqlStorage) LoadScenes(appid string) (scenes []*WxScene, err error) {
+	err = s.db(func(db *gorm.DB) error {
+		return db.Where("appid = ?", appid).Order("scene").Find(&scenes).Error
+	})
+	return
+}
+
+func (s *sqlStorage) SaveWebhook(h *WxWebhook) (err error) {
+	err = s.db(func(db *gorm.DB) error {
+		return db.Save(h).Error
+	})
+	return
+}
+
+func (s *sqlStorage) LoadWebhooks(appid string) (hooks []*WxWebhook, err error) {
+	err = s.db(func(db *gorm.DB) error {
+		return db.Where("appid = ?", appid).Order("url").Find(&hooks).Error
+	})
+	return
+}
+
+func (s *sqlStorage) DeleteWebhook(appid, url string) (err error) {
+	err = s.db(func(db *gorm.DB) error {
+		r := db.Where("appid = ? AND url = ?", appid, url).Delete(&WxWebhook{})
+		if r.Error == nil && r.RowsAffected == 0 {
+			return ErrNotFound
+		}
+		return r.Error
+	})
+	return
+}
+
+func (s *sqlStorage) SaveTenant(t *WxTenant) (err error) {
+	err = s.db(func(db *gorm.DB) error {
+		return db.Save(t).Error
+	})
+	return
+}
+
+func (s *sqlStorage) LoadTenant(apiKey string) (t *WxTenant, err error) {
+	err = s.db(func(db *gorm.DB) error {
+		r := WxTenant{}
+		t = &r
+		return db.Where("api_key = ?", apiKey).First(&r).Error
+	})
+	return
+}
+
+func (s *sqlStorage) DeleteTenant(name string) (err error) {
+	err = s.db(func(db *gorm.DB) error {
+		r := db.Where("name = ?", name).Delete(&WxTenant{})
+		if r.Error == nil && r.RowsAffected == 0 {
+			return ErrNotFound
+		}
+		return r.Error
+	})
+	return
+}
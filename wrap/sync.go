@@ -0,0 +1,371 @@
+package wrap
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	wx "wechat-proxy/wechat"
+)
+
+// max count of openid in one user/info/batchget request
+const syncBatchSize = 100
+
+// doc: https://mp.weixin.qq.com/wiki?t=resource/res_main&id=mp1421140840
+// doc: https://mp.weixin.qq.com/wiki?t=resource/res_main&id=mp1421140839
+type WechatSyncServer struct {
+	wx.WechatClient
+	progress map[string]*syncProgress
+	lock     sync.Mutex
+	closed   bool
+	running  sync.WaitGroup
+}
+
+type syncProgress struct {
+	AppId        string
+	Status       string // running, done, failed
+	ErrMsg       string
+	Total        int // 关注者总数
+	Fetched      int // 已拉取的openid数
+	Synced       int // 已更新的用户信息数
+	Unsubscribed int // 标记为取消关注的用户数
+	StartTime    uint64
+	FinishTime   uint64
+	Interval     int // 定时同步间隔(秒)，0表示不定时同步
+	stop         chan bool
+}
+
+func NewSyncServer() *WechatSyncServer {
+	srv := &WechatSyncServer{}
+	srv.progress = make(map[string]*syncProgress)
+	return srv
+}
+
+// /user/sync?appid=...&secret=...&interval=   (POST: start sync, GET: show progress)
+func (srv *WechatSyncServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	wx.Debugln(r.RequestURI)
+	if _, ok := requireApp(w, r); !ok {
+		return
+	}
+	r.ParseForm()
+	f := r.Form
+	appid, secret := f.Get("appid"), f.Get("secret")
+
+	if r.Method != http.MethodPost {
+		srv.lock.Lock()
+		p := srv.progress[appid]
+		var c syncProgress
+		if p != nil {
+			c = *p
+		}
+		srv.lock.Unlock()
+		if p == nil {
+			w.Write(wx.JsonResponse(ErrNotFound))
+			return
+		}
+		w.Write(wx.JsonResponse(&c))
+		return
+	}
+
+	hostUrl := srv.HostUrl(r)
+	if v := f.Get("interval"); v != "" {
+		interval, _ := strconv.Atoi(v)
+		srv.setSchedule(hostUrl, appid, secret, interval)
+	}
+	_, err := srv.start(hostUrl, appid, secret)
+	if err != nil {
+		w.Write(wx.JsonResponse(err))
+		return
+	}
+	w.Write(wx.JsonResponse(nil))
+}
+
+// Close stops schedules and new syncs, and waits for running syncs,
+// it returns false if they are not finished in timeout.
+func (srv *WechatSyncServer) Close(timeout time.Duration) bool {
+	srv.lock.Lock()
+	srv.closed = true
+	for _, p := range srv.progress {
+		if p.stop != nil {
+			close(p.stop)
+			p.stop = nil
+		}
+	}
+	srv.lock.Unlock()
+
+	done := make(chan bool)
+	go func() {
+		srv.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (srv *WechatSyncServer) isClosed() bool {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	return srv.closed
+}
+
+// start sync job in background, only one job for each appid.
+func (srv *WechatSyncServer) start(hostUrl, appid, secret string) (p *syncProgress, err error) {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+
+	if srv.closed {
+		err = errServerClosed
+		return
+	}
+	p = srv.progress[appid]
+	if p != nil && p.Status == "running" {
+		err = errors.New("sync is running")
+		return
+	}
+	if p == nil {
+		p = &syncProgress{AppId: appid}
+		srv.progress[appid] = p
+	}
+	p.Status = "running"
+	p.ErrMsg = ""
+	p.Total, p.Fetched, p.Synced, p.Unsubscribed = 0, 0, 0, 0
+	p.StartTime = uint64(time.Now().Unix())
+	p.FinishTime = 0
+
+	srv.running.Add(1)
+	go srv.run(hostUrl, appid, secret, p)
+	return
+}
+
+func (srv *WechatSyncServer) setSchedule(hostUrl, appid, secret string, interval int) {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+
+	p := srv.progress[appid]
+	if p == nil {
+		p = &syncProgress{AppId: appid}
+		srv.progress[appid] = p
+	}
+	if p.stop != nil {
+		close(p.stop)
+		p.stop = nil
+	}
+	p.Interval = interval
+	if interval <= 0 || srv.closed {
+		return
+	}
+
+	// ticker.Stop does not close ticker.C, the schedule exits by stop channel
+	stop := make(chan bool)
+	p.stop = stop
+	go func() {
+		ticker := time.NewTicker(time.Duration(interval) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				_, err := srv.start(hostUrl, appid, secret)
+				if err != nil {
+					log.Println(err.Error())
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+func (srv *WechatSyncServer) run(hostUrl, appid, secret string, p *syncProgress) {
+	defer srv.running.Done()
+	err := srv.sync(hostUrl, appid, secret, p)
+
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	p.Status = "done"
+	if err != nil {
+		log.Println(err.Error())
+		p.Status = "failed"
+		p.ErrMsg = err.Error()
+	}
+	p.FinishTime = uint64(time.Now().Unix())
+}
+
+func (srv *WechatSyncServer) sync(hostUrl, appid, secret string, p *syncProgress) (err error) {
+
+	// fetch all openids
+	openids, err := srv.fetchOpenIds(hostUrl, appid, secret, p)
+	if err != nil {
+		return
+	}
+
+	// fetch user info and upsert, stop between batches when closed
+	for i := 0; i < len(openids); i += syncBatchSize {
+		if srv.isClosed() {
+			err = errServerClosed
+			return
+		}
+		end := i + syncBatchSize
+		if end > len(openids) {
+			end = len(openids)
+		}
+		var infos []*wxUserInfo
+		infos, err = srv.batchGet(hostUrl, appid, secret, openids[i:end])
+		if err != nil {
+			return
+		}
+		for _, info := range infos {
+			u, e := NewStorage().LoadUser(appid, info.Openid)
+			exists := e == nil && u.OpenId != ""
+			if !exists {
+				u = &WxUser{AppId: appid, OpenId: info.Openid}
+			}
+			old := *u
+			u.setProfile(info)
+			if exists && old == *u {
+				continue
+			}
+			err = NewStorage().SaveUser(u)
+			if err != nil {
+				return
+			}
+			if exists {
+				notifyWebhooks("profile", u)
+			}
+		}
+		srv.lock.Lock()
+		p.Synced += len(infos)
+		srv.lock.Unlock()
+	}
+
+	// mark missing users as unsubscribed
+	if srv.isClosed() {
+		err = errServerClosed
+		return
+	}
+	followers := make(map[string]bool, len(openids))
+	for _, openid := range openids {
+		followers[openid] = true
+	}
+	users, err := NewStorage().LoadUsers(appid)
+	if err != nil {
+		return
+	}
+	now := uint64(time.Now().Unix())
+	for _, u := range users {
+		if !u.Subscribe || followers[u.OpenId] {
+			continue
+		}
+		u.Subscribe = false
+		u.UnSubscribeTime = now
+		err = NewStorage().SaveUser(u)
+		if err != nil {
+			return
+		}
+		notifyWebhooks("unsubscribe", u)
+		srv.lock.Lock()
+		p.Unsubscribed++
+		srv.lock.Unlock()
+	}
+	return
+}
+
+func (srv *WechatSyncServer) fetchOpenIds(hostUrl, appid, secret string, p *syncProgress) (openids []string, err error) {
+	next_openid := ""
+	for {
+		access_token, wxErr := srv.GetAccessToken(hostUrl, appid, secret)
+		if wxErr != nil {
+			err = errors.New(wxErr.String())
+			return
+		}
+
+		var list struct {
+			wx.WxError
+			Total int `json:"total"`
+			Count int `json:"count"`
+			Data  struct {
+				OpenId []string `json:"openid"`
+			} `json:"data"`
+			NextOpenId string `json:"next_openid"`
+		}
+		_url := fmt.Sprintf(wx.ApiBaseUrl+"/cgi-bin/user/get?access_token=%s&next_openid=%s",
+			access_token, next_openid)
+		_, err = wx.HttpGetJson(_url, &list)
+		if err != nil {
+			return
+		}
+		if !list.Success() {
+			err = errors.New(list.String())
+			return
+		}
+
+		openids = append(openids, list.Data.OpenId...)
+		srv.lock.Lock()
+		p.Total = list.Total
+		p.Fetched = len(openids)
+		srv.lock.Unlock()
+
+		if list.Count == 0 || list.NextOpenId == "" || len(openids) >= list.Total {
+			return
+		}
+		next_openid = list.NextOpenId
+	}
+}
+
+func (srv *WechatSyncServer) batchGet(hostUrl, appid, secret string, openids []string) (infos []*wxUserInfo, err error) {
+	access_token, wxErr := srv.GetAccessToken(hostUrl, appid, secret)
+	if wxErr != nil {
+		err = errors.New(wxErr.String())
+		return
+	}
+
+	type userItem struct {
+		OpenId string `json:"openid"`
+		Lang   string `json:"lang"`
+	}
+	req := struct {
+		UserList []userItem `json:"user_list"`
+	}{}
+	for _, openid := range openids {
+		req.UserList = append(req.UserList, userItem{openid, "zh_CN"})
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return
+	}
+
+	_url := fmt.Sprintf(wx.ApiBaseUrl+"/cgi-bin/user/info/batchget?access_token=%s", access_token)
+	resp, err := http.Post(_url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+
+	var result struct {
+		wx.WxError
+		UserInfoList []*wxUserInfo `json:"user_info_list"`
+	}
+	err = json.Unmarshal(body, &result)
+	if err != nil {
+		return
+	}
+	if !result.Success() {
+		err = errors.New(result.String())
+		return
+	}
+	infos = result.UserInfoList
+	return
+}
@@ -0,0 +1,142 @@
+package wrap
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSyncFollowers(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cgi-bin/user/get", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("next_openid") == "" {
+			w.Write([]byte(`{"total":3,"count":2,"data":{"openid":["o1","o2"]},"next_openid":"o2"}`))
+			return
+		}
+		w.Write([]byte(`{"total":3,"count":1,"data":{"openid":["o4"]},"next_openid":"o4"}`))
+	})
+	mux.HandleFunc("/cgi-bin/user/info/batchget", func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			UserList []struct{ OpenId string } `json:"user_list"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		var infos []string
+		for _, u := range req.UserList {
+			infos = append(infos, fmt.Sprintf(`{"subscribe":1,"openid":%q,"nickname":"nick-%s","subscribe_time":100,"tagid_list":[2]}`, u.OpenId, u.OpenId))
+		}
+		fmt.Fprintf(w, `{"user_info_list":[%s]}`, strings.Join(infos, ","))
+	})
+	ts := newWechatMock(t, mux)
+
+	// o1 changed, o2 unchanged, o3 unsubscribed, o4 new
+	NewStorage().SaveUser(&WxUser{AppId: "wx-sync", OpenId: "o1", Subscribe: true, Nickname: "old", SubscribeTime: 100})
+	o2 := &WxUser{AppId: "wx-sync", OpenId: "o2"}
+	o2.setProfile(&wxUserInfo{Subscribe: 1, Openid: "o2", Nickname: "nick-o2", SubscribeTime: 100, TagIdList: []int{2}})
+	NewStorage().SaveUser(o2)
+	NewStorage().SaveUser(&WxUser{AppId: "wx-sync", OpenId: "o3", Subscribe: true})
+
+	srv := NewSyncServer()
+	p, err := srv.start(ts.URL, "wx-sync", "s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := srv.start(ts.URL, "wx-sync", "s"); err == nil {
+		t.Fatal("second job started")
+	}
+	for i := 0; i < 100; i++ {
+		srv.lock.Lock()
+		status := p.Status
+		srv.lock.Unlock()
+		if status != "running" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if p.Status != "done" || p.Total != 3 || p.Fetched != 3 || p.Synced != 3 || p.Unsubscribed != 1 {
+		t.Fatal(p)
+	}
+
+	for _, v := range []struct {
+		OpenId    string
+		Nickname  string
+		Subscribe bool
+	}{
+		{"o1", "nick-o1", true},
+		{"o2", "nick-o2", true},
+		{"o3", "", false},
+		{"o4", "nick-o4", true},
+	} {
+		u, err := NewStorage().LoadUser("wx-sync", v.OpenId)
+		if err != nil || u.Nickname != v.Nickname || u.Subscribe != v.Subscribe {
+			t.Fatal(v, u, err)
+		}
+	}
+}
+
+func TestSyncSchedule(t *testing.T) {
+	srv := NewSyncServer()
+	n := runtime.NumGoroutine()
+	srv.setSchedule("http://127.0.0.1:0", "wx-schedule", "s", 3600)
+	srv.setSchedule("http://127.0.0.1:0", "wx-schedule", "s", 7200)
+	if p := srv.progress["wx-schedule"]; p.Interval != 7200 || p.stop == nil {
+		t.Fatal(p)
+	}
+	srv.setSchedule("http://127.0.0.1:0", "wx-schedule", "s", 0)
+	if p := srv.progress["wx-schedule"]; p.Interval != 0 || p.stop != nil {
+		t.Fatal(p)
+	}
+
+	// replaced and cancelled schedules exit
+	for i := 0; i < 100 && runtime.NumGoroutine() > n; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if runtime.NumGoroutine() > n {
+		t.Fatal("schedule goroutine leaked", runtime.NumGoroutine(), n)
+	}
+}
+
+func TestSyncClose(t *testing.T) {
+	block := make(chan bool)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cgi-bin/user/get", func(w http.ResponseWriter, r *http.Request) {
+		<-block
+		w.Write([]byte(`{"total":1,"count":1,"data":{"openid":["o1"]},"next_openid":"o1"}`))
+	})
+	mux.HandleFunc("/cgi-bin/user/info/batchget", func(w http.ResponseWriter, r *http.Request) {
+		t.Error("synced after close")
+		w.Write([]byte(`{"user_info_list":[]}`))
+	})
+	ts := newWechatMock(t, mux)
+
+	srv := NewSyncServer()
+	srv.setSchedule(ts.URL, "wx-close", "s", 3600)
+	p, err := srv.start(ts.URL, "wx-close", "s")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// running sync is waited, and stops before saving users
+	if srv.Close(50 * time.Millisecond) {
+		t.Fatal("running sync is not waited")
+	}
+	close(block)
+	if !srv.Close(time.Second) {
+		t.Fatal("sync is not finished")
+	}
+	if p.Status != "failed" || p.ErrMsg != errServerClosed.Error() || p.stop != nil {
+		t.Fatal(p)
+	}
+
+	// no syncs or schedules after close
+	if _, err := srv.start(ts.URL, "wx-close", "s"); err != errServerClosed {
+		t.Fatal(err)
+	}
+	srv.setSchedule(ts.URL, "wx-close", "s", 3600)
+	if p.stop != nil {
+		t.Fatal("scheduled after close")
+	}
+}
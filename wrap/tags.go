@@ -0,0 +1,239 @@
+package wrap
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	wx "wechat-proxy/wechat"
+)
+
+// max count of openid in one tags/members/batchtagging request
+const tagBatchSize = 50
+
+// doc: https://mp.weixin.qq.com/wiki?t=resource/res_main&id=mp1421140837
+type WechatTagServer struct {
+	wx.WechatClient
+}
+
+func NewTagServer() *WechatTagServer {
+	srv := &WechatTagServer{}
+	return srv
+}
+
+// /tags?appid=...&secret=...
+// /tags/create?appid=...&secret=...&name=...
+// /tags/update?appid=...&secret=...&id=...&name=...
+// /tags/delete?appid=...&secret=...&id=...
+// /tags/tagging?appid=...&secret=...&id=...&openid=...&openid=...
+// /tags/untagging?appid=...&secret=...&id=...&openid=...&openid=...
+func (srv *WechatTagServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	wx.Debugln(r.RequestURI)
+	if _, ok := requireApp(w, r); !ok {
+		return
+	}
+	r.ParseForm()
+
+	var body []byte
+	var err error
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/tags"):
+		body, err = srv.callApi(r, "tags/get", nil)
+	case strings.HasSuffix(r.URL.Path, "/create"):
+		body, err = srv.create(r)
+	case strings.HasSuffix(r.URL.Path, "/update"):
+		body, err = srv.update(r)
+	case strings.HasSuffix(r.URL.Path, "/delete"):
+		body, err = srv.delete(r)
+	case strings.HasSuffix(r.URL.Path, "/tagging"):
+		body, err = srv.tagging(r, true)
+	case strings.HasSuffix(r.URL.Path, "/untagging"):
+		body, err = srv.tagging(r, false)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		w.Write(wx.JsonResponse(err))
+		return
+	}
+	w.Write(body)
+}
+
+func (srv *WechatTagServer) create(r *http.Request) (body []byte, err error) {
+	name := r.Form.Get("name")
+	if name == "" || len(name) > 30 {
+		err = errors.New("tag name must be 1 to 30 bytes")
+		return
+	}
+	req := map[string]interface{}{
+		"tag": map[string]interface{}{"name": name},
+	}
+	body, err = srv.callApi(r, "tags/create", req)
+	return
+}
+
+func (srv *WechatTagServer) update(r *http.Request) (body []byte, err error) {
+	id, err := strconv.Atoi(r.Form.Get("id"))
+	if err != nil {
+		return
+	}
+	name := r.Form.Get("name")
+	if name == "" || len(name) > 30 {
+		err = errors.New("tag name must be 1 to 30 bytes")
+		return
+	}
+	req := map[string]interface{}{
+		"tag": map[string]interface{}{"id": id, "name": name},
+	}
+	body, err = srv.callApi(r, "tags/update", req)
+	return
+}
+
+// delete tag from wechat, and remove it from local users
+func (srv *WechatTagServer) delete(r *http.Request) (body []byte, err error) {
+	id, err := strconv.Atoi(r.Form.Get("id"))
+	if err != nil {
+		return
+	}
+	req := map[string]interface{}{
+		"tag": map[string]interface{}{"id": id},
+	}
+	body, err = srv.callApi(r, "tags/delete", req)
+	if err != nil {
+		return
+	}
+
+	appid := r.Form.Get("appid")
+	users, err := NewStorage().LoadUsers(appid)
+	if err != nil {
+		return
+	}
+	for _, u := range users {
+		if u.removeTag(id) {
+			err = NewStorage().SaveUser(u)
+			if err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// batch tag or untag users, and update local users
+func (srv *WechatTagServer) tagging(r *http.Request, add bool) (body []byte, err error) {
+	f := r.Form
+	id, err := strconv.Atoi(f.Get("id"))
+	if err != nil {
+		return
+	}
+	openids := f["openid"]
+	if len(openids) == 0 {
+		err = errors.New("openid is required")
+		return
+	}
+
+	api := "tags/members/batchtagging"
+	if !add {
+		api = "tags/members/batchuntagging"
+	}
+	appid := f.Get("appid")
+	for i := 0; i < len(openids); i += tagBatchSize {
+		end := i + tagBatchSize
+		if end > len(openids) {
+			end = len(openids)
+		}
+		req := map[string]interface{}{
+			"openid_list": openids[i:end],
+			"tagid":       id,
+		}
+		body, err = srv.callApi(r, api, req)
+		if err != nil {
+			return
+		}
+
+		for _, openid := range openids[i:end] {
+			u, e := NewStorage().LoadUser(appid, openid)
+			if e != nil || u.OpenId == "" {
+				continue
+			}
+			changed := false
+			if add {
+				changed = u.addTag(id)
+			} else {
+				changed = u.removeTag(id)
+			}
+			if changed {
+				err = NewStorage().SaveUser(u)
+				if err != nil {
+					return
+				}
+			}
+		}
+	}
+	return
+}
+
+// call wechat tags api, err is not nil if wechat returns error.
+func (srv *WechatTagServer) callApi(r *http.Request, api string, req interface{}) (body []byte, err error) {
+	f := r.Form
+	access_token, wxErr := srv.GetAccessToken(srv.HostUrl(r), f.Get("appid"), f.Get("secret"))
+	if wxErr != nil {
+		err = errors.New(wxErr.String())
+		return
+	}
+
+	_url := fmt.Sprintf(wx.ApiBaseUrl+"/cgi-bin/%s?access_token=%s", api, access_token)
+	if req == nil {
+		body, err = wx.HttpGetJson(_url, nil)
+	} else {
+		var data []byte
+		data, err = json.Marshal(req)
+		if err != nil {
+			return
+		}
+		var resp *http.Response
+		resp, err = http.Post(_url, "application/json", bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		defer resp.Body.Close()
+		body, err = ioutil.ReadAll(resp.Body)
+	}
+	if err != nil {
+		return
+	}
+
+	var e wx.WxError
+	json.Unmarshal(body, &e)
+	if !e.Success() {
+		err = errors.New(e.String())
+	}
+	return
+}
+
+func (u *WxUser) addTag(id int) bool {
+	ids := u.tagIds()
+	for _, v := range ids {
+		if v == id {
+			return false
+		}
+	}
+	u.setTags(append(ids, id))
+	return true
+}
+
+func (u *WxUser) removeTag(id int) bool {
+	ids := u.tagIds()
+	for i, v := range ids {
+		if v == id {
+			u.setTags(append(ids[:i], ids[i+1:]...))
+			return true
+		}
+	}
+	return false
+}
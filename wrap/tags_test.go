@@ -0,0 +1,24 @@
+package wrap
+
+import (
+	"testing"
+)
+
+func TestUserAddRemoveTag(t *testing.T) {
+	u := &WxUser{}
+	if !u.addTag(2) || !u.addTag(101) || u.addTag(2) {
+		t.Fatal(u.Tags)
+	}
+	if u.Tags != ",2,101," {
+		t.Fatal(u.Tags)
+	}
+	if u.removeTag(3) || !u.removeTag(2) {
+		t.Fatal(u.Tags)
+	}
+	if u.Tags != ",101," {
+		t.Fatal(u.Tags)
+	}
+	if !u.removeTag(101) || u.Tags != "" {
+		t.Fatal(u.Tags)
+	}
+}
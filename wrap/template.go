@@ -0,0 +1,314 @@
+package wrap
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	wx "wechat-proxy/wechat"
+)
+
+// doc: https://mp.weixin.qq.com/wiki?t=resource/res_main&id=mp1433751277
+type WechatTemplateServer struct {
+	wx.WechatClient
+	lock sync.Mutex // messages are saved by sender and TEMPLATESENDJOBFINISH events
+}
+
+func NewTemplateServer() *WechatTemplateServer {
+	srv := &WechatTemplateServer{}
+	return srv
+}
+
+// /template/send?appid=...&secret=...&openid=&template=
+// /template/alias?appid=...&alias=
+// /template/status?appid=...&msgid=...
+func (srv *WechatTemplateServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	wx.Debugln(r.RequestURI)
+	if _, ok := requireApp(w, r); !ok {
+		return
+	}
+	r.ParseForm()
+
+	if strings.HasSuffix(r.URL.Path, "/send") {
+		srv.send(w, r)
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "/alias") {
+		srv.alias(w, r)
+		return
+	}
+	if strings.HasSuffix(r.URL.Path, "/status") {
+		srv.status(w, r)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+func (srv *WechatTemplateServer) send(w http.ResponseWriter, r *http.Request) {
+	f := r.Form
+	appid, secret := f.Get("appid"), f.Get("secret")
+
+	// parse message
+	m := &templateMsg{}
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.Write(wx.JsonResponse(err))
+		return
+	}
+	if len(body) > 0 {
+		err = json.Unmarshal(body, m)
+		if err != nil {
+			w.Write(wx.JsonResponse(err))
+			return
+		}
+	}
+	if f.Get("openid") != "" {
+		m.ToUser = f.Get("openid")
+	}
+	if f.Get("template") != "" {
+		m.Alias = f.Get("template")
+	}
+	if f.Get("url") != "" {
+		m.Url = f.Get("url")
+	}
+
+	// fill defaults of registered alias
+	alias := m.Alias
+	if alias == "" {
+		alias = m.TemplateId
+	}
+	if t, err := NewStorage().LoadTemplate(appid, alias); err == nil && t.TemplateId != "" {
+		srv.fillDefaults(m, t)
+	} else if m.TemplateId == "" {
+		m.TemplateId = m.Alias
+	}
+	m.Alias = ""
+
+	// send
+	access_token, wxErr := srv.GetAccessToken(srv.HostUrl(r), appid, secret)
+	if wxErr != nil {
+		w.Write(wxErr.Serialize())
+		return
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		w.Write(wx.JsonResponse(err))
+		return
+	}
+	_url := fmt.Sprintf(wx.ApiBaseUrl+"/cgi-bin/message/template/send?access_token=%s", access_token)
+	resp, err := http.Post(_url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		w.Write(wx.JsonResponse(err))
+		return
+	}
+	defer resp.Body.Close()
+	resp_body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		w.Write(wx.JsonResponse(err))
+		return
+	}
+
+	// record msgid before response, so status is available to the client
+	result := &struct {
+		wx.WxError
+		MsgId uint64 `json:"msgid"`
+	}{}
+	err = json.Unmarshal(resp_body, result)
+	if err == nil && result.Success() {
+		srv.saveMsg(appid, result.MsgId, m)
+	}
+	w.Write(resp_body)
+}
+
+// the finish event may arrive before the message is saved, its result is kept then.
+func (srv *WechatTemplateServer) saveMsg(appid string, msgid uint64, m *templateMsg) {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+
+	msg, err := NewStorage().LoadTemplateMsg(appid, msgid)
+	if err != nil {
+		msg = &WxTemplateMsg{AppId: appid, MsgId: msgid, Status: "sending"}
+	}
+	msg.OpenId = m.ToUser
+	msg.TemplateId = m.TemplateId
+	msg.SendTime = uint64(time.Now().Unix())
+	err = NewStorage().SaveTemplateMsg(msg)
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+func (srv *WechatTemplateServer) fillDefaults(m *templateMsg, t *WxTemplate) {
+	m.TemplateId = t.TemplateId
+	if m.Url == "" {
+		m.Url = t.Url
+	}
+	if m.MiniProgram == nil && t.MiniAppId != "" {
+		m.MiniProgram = &templateMiniProgram{AppId: t.MiniAppId, PagePath: t.MiniPage}
+	}
+	if t.Data == "" {
+		return
+	}
+	var data map[string]templateValue
+	err := json.Unmarshal([]byte(t.Data), &data)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	if m.Data == nil {
+		m.Data = make(map[string]templateValue)
+	}
+	for k, v := range data {
+		if _, ok := m.Data[k]; !ok {
+			m.Data[k] = v
+		}
+	}
+}
+
+// GET: list registered templates, POST: register template alias
+func (srv *WechatTemplateServer) alias(w http.ResponseWriter, r *http.Request) {
+	appid := r.Form.Get("appid")
+
+	if r.Method == http.MethodGet {
+		if alias := r.Form.Get("alias"); alias != "" {
+			t, err := NewStorage().LoadTemplate(appid, alias)
+			if err != nil {
+				w.Write(wx.JsonResponse(err))
+				return
+			}
+			w.Write(wx.JsonResponse(t))
+			return
+		}
+		ts, err := NewStorage().LoadTemplates(appid)
+		if err != nil {
+			w.Write(wx.JsonResponse(err))
+			return
+		}
+		w.Write(wx.JsonResponse(ts))
+		return
+	}
+
+	m := &templateMsg{}
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.Write(wx.JsonResponse(err))
+		return
+	}
+	err = json.Unmarshal(body, m)
+	if err != nil {
+		w.Write(wx.JsonResponse(err))
+		return
+	}
+	if m.Alias == "" || m.TemplateId == "" {
+		w.Write(wx.NewErrorStr("alias and template_id required").Serialize())
+		return
+	}
+
+	t := &WxTemplate{
+		AppId:      appid,
+		Alias:      m.Alias,
+		TemplateId: m.TemplateId,
+		Url:        m.Url,
+	}
+	if m.MiniProgram != nil {
+		t.MiniAppId = m.MiniProgram.AppId
+		t.MiniPage = m.MiniProgram.PagePath
+	}
+	if m.Data != nil {
+		data, _ := json.Marshal(m.Data)
+		t.Data = string(data)
+	}
+	err = NewStorage().SaveTemplate(t)
+	if err != nil {
+		w.Write(wx.JsonResponse(err))
+		return
+	}
+	w.Write(wx.JsonResponse(nil))
+}
+
+func (srv *WechatTemplateServer) status(w http.ResponseWriter, r *http.Request) {
+	appid := r.Form.Get("appid")
+	msgid, err := strconv.ParseUint(r.Form.Get("msgid"), 10, 64)
+	if err != nil {
+		w.Write(wx.JsonResponse(err))
+		return
+	}
+	m, err := NewStorage().LoadTemplateMsg(appid, msgid)
+	if err != nil {
+		w.Write(wx.JsonResponse(err))
+		return
+	}
+	w.Write(wx.JsonResponse(m))
+}
+
+// JobFinish handles TEMPLATESENDJOBFINISH event from WechatMessageServer.
+func (srv *WechatTemplateServer) JobFinish(appid string, msg []byte) {
+	var e struct {
+		FromUserName string
+		CreateTime   uint64
+		MsgID        uint64
+		Status       string
+	}
+	err := xml.Unmarshal(msg, &e)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	log.Printf("template job finish: %#v\n", e)
+
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	m, err := NewStorage().LoadTemplateMsg(appid, e.MsgID)
+	if err != nil {
+		m = &WxTemplateMsg{
+			AppId:  appid,
+			MsgId:  e.MsgID,
+			OpenId: e.FromUserName,
+		}
+	}
+	m.Status = e.Status
+	m.FinishTime = e.CreateTime
+
+	err = NewStorage().SaveTemplateMsg(m)
+	if err != nil {
+		log.Println(err.Error())
+	}
+}
+
+type templateMsg struct {
+	ToUser      string                   `json:"touser"`
+	TemplateId  string                   `json:"template_id"`
+	Alias       string                   `json:"alias,omitempty"`
+	Url         string                   `json:"url,omitempty"`
+	MiniProgram *templateMiniProgram     `json:"miniprogram,omitempty"`
+	Data        map[string]templateValue `json:"data"`
+}
+
+type templateMiniProgram struct {
+	AppId    string `json:"appid"`
+	PagePath string `json:"pagepath"`
+}
+
+type templateValue struct {
+	Value string `json:"value"`
+	Color string `json:"color,omitempty"`
+}
+
+// accept both {"value":"...","color":"..."} and plain "..."
+func (v *templateValue) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		v.Color = ""
+		return json.Unmarshal(b, &v.Value)
+	}
+	type value templateValue
+	return json.Unmarshal(b, (*value)(v))
+}
@@ -0,0 +1,124 @@
+package wrap
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestTemplateSend(t *testing.T) {
+	var sent templateMsg
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cgi-bin/message/template/send", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		sent = templateMsg{}
+		json.Unmarshal(body, &sent)
+		if strings.Contains(string(body), `"alias"`) {
+			t.Error("alias is sent to wechat", string(body))
+		}
+		w.Write([]byte(`{"errcode":0,"errmsg":"ok","msgid":200228332}`))
+	})
+	mux.Handle("/template/", asApp(NewTemplateServer(), &WxApp{Key: "tpl", AppId: "wx-tpl"}))
+	ts := newWechatMock(t, mux)
+
+	// register alias with defaults
+	alias := `{"alias":"order","template_id":"TID","url":"http://a/order",
+		"data":{"first":"hello","remark":{"value":"thanks","color":"#f00"}}}`
+	resp, err := http.Post(ts.URL+"/template/alias?appid=wx-tpl", "application/json", strings.NewReader(alias))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// send by alias, data given overrides defaults
+	resp, err = http.Post(ts.URL+"/template/send?appid=wx-tpl&secret=s&openid=o1&template=order",
+		"application/json", strings.NewReader(`{"data":{"first":"hi"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if sent.TemplateId != "TID" || sent.Url != "http://a/order" || sent.ToUser != "o1" ||
+		sent.Data["first"].Value != "hi" || sent.Data["remark"].Color != "#f00" {
+		t.Fatal(sent)
+	}
+
+	// unknown alias is sent as template id
+	resp, err = http.Post(ts.URL+"/template/send?appid=wx-tpl&secret=s&openid=o1&template=RAW",
+		"application/json", strings.NewReader(`{"data":{"first":"hi"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if sent.TemplateId != "RAW" || sent.Url != "" || len(sent.Data) != 1 {
+		t.Fatal(sent)
+	}
+
+	// status is tracked until job finish
+	m, err := NewStorage().LoadTemplateMsg("wx-tpl", 200228332)
+	if err != nil || m.Status != "sending" || m.OpenId != "o1" {
+		t.Fatal(m, err)
+	}
+	NewTemplateServer().JobFinish("wx-tpl", []byte(`<xml>
+<FromUserName><![CDATA[o1]]></FromUserName>
+<CreateTime>1395658984</CreateTime>
+<MsgType><![CDATA[event]]></MsgType>
+<Event><![CDATA[TEMPLATESENDJOBFINISH]]></Event>
+<MsgID>200228332</MsgID>
+<Status><![CDATA[failed:user block]]></Status>
+</xml>`))
+	resp, err = http.Get(ts.URL + "/template/status?appid=wx-tpl&msgid=200228332")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	m = &WxTemplateMsg{}
+	json.NewDecoder(resp.Body).Decode(m)
+	if m.Status != "failed:user block" || m.FinishTime != 1395658984 || m.TemplateId != "RAW" {
+		t.Fatal(m)
+	}
+}
+
+func TestTemplateFillDefaults(t *testing.T) {
+	srv := NewTemplateServer()
+	m := &templateMsg{Url: "http://given"}
+	srv.fillDefaults(m, &WxTemplate{TemplateId: "TID", Url: "http://default", MiniAppId: "wxa", MiniPage: "index",
+		Data: `{"first":"a","remark":{"value":"b","color":"#000"}}`})
+	if m.TemplateId != "TID" || m.Url != "http://given" || m.MiniProgram == nil || m.MiniProgram.PagePath != "index" {
+		t.Fatal(m)
+	}
+	if m.Data["first"].Value != "a" || m.Data["remark"].Color != "#000" {
+		t.Fatal(m.Data)
+	}
+}
+
+func TestTemplateFinishBeforeSave(t *testing.T) {
+	srv := NewTemplateServer()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cgi-bin/message/template/send", func(w http.ResponseWriter, r *http.Request) {
+		// finish event arrives before send returns
+		srv.JobFinish("wx-tpl2", []byte(`<xml>
+<FromUserName><![CDATA[o1]]></FromUserName>
+<CreateTime>1395658984</CreateTime>
+<MsgID>300</MsgID>
+<Status><![CDATA[success]]></Status>
+</xml>`))
+		w.Write([]byte(`{"errcode":0,"errmsg":"ok","msgid":300}`))
+	})
+	mux.Handle("/template/", asApp(srv, &WxApp{Key: "tpl2", AppId: "wx-tpl2"}))
+	ts := newWechatMock(t, mux)
+
+	resp, err := http.Post(ts.URL+"/template/send?appid=wx-tpl2&secret=s&openid=o1&template=TID",
+		"application/json", strings.NewReader(`{"data":{"first":"hi"}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// finish status is kept, and the message is recorded when the response is returned
+	m, err := NewStorage().LoadTemplateMsg("wx-tpl2", 300)
+	if err != nil || m.Status != "success" || m.FinishTime != 1395658984 || m.TemplateId != "TID" || m.SendTime == 0 {
+		t.Fatal(m, err)
+	}
+}
@@ -0,0 +1,69 @@
+package wrap
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	usageOk = iota
+	usageError
+	usageDenied
+)
+
+// usage of an app since startup
+type appUsage struct {
+	Calls    uint64            // 转发成功的请求数
+	Errors   uint64            // 转发失败的请求数
+	Denied   uint64            // 接口未授权或签名校验失败的请求数
+	LastCall uint64            // 最后调用时间
+	Paths    map[string]uint64 // 按接口统计的请求数
+}
+
+var usages = struct {
+	sync.Mutex
+	m map[string]*appUsage
+}{m: make(map[string]*appUsage)}
+
+func recordUsage(key, path string, result int) {
+	usages.Lock()
+	defer usages.Unlock()
+	u := usages.m[key]
+	if u == nil {
+		u = &appUsage{Paths: make(map[string]uint64)}
+		usages.m[key] = u
+	}
+	switch result {
+	case usageOk:
+		u.Calls++
+	case usageError:
+		u.Errors++
+	case usageDenied:
+		u.Denied++
+	}
+	u.LastCall = uint64(time.Now().Unix())
+
+	// count by first segment of path, e.g. /api, /msg, /pay
+	name := "/" + strings.SplitN(strings.TrimPrefix(path, "/"), "/", 2)[0]
+	u.Paths[name]++
+}
+
+func loadUsage(key string) (u appUsage) {
+	usages.Lock()
+	defer usages.Unlock()
+	if v := usages.m[key]; v != nil {
+		u = *v
+		u.Paths = make(map[string]uint64, len(v.Paths))
+		for k, n := range v.Paths {
+			u.Paths[k] = n
+		}
+	}
+	return
+}
+
+func removeUsage(key string) {
+	usages.Lock()
+	defer usages.Unlock()
+	delete(usages.m, key)
+}
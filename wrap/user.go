@@ -20,17 +20,43 @@ func NewUserServer() *WechatUserServer {
 	return srv
 }
 
+// followers are only served under /app/<key>/user, events are posted there by /app/<key>/msg.
 func (srv *WechatUserServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	log.Println(r.RequestURI)
+	wx.Debugln(r.RequestURI)
+	if _, ok := requireApp(w, r); !ok {
+		return
+	}
 
 	if r.Method == http.MethodGet {
+		r.ParseForm()
 
-		// query user info by appid and other conditions
+		if strings.HasSuffix(r.URL.Path, "/report") {
+			srv.report(w, r)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/track") {
+			srv.track(w, r)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/near") {
+			srv.near(w, r)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/identity") {
+			srv.identity(w, r)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/resolve") {
+			srv.resolve(w, r)
+			return
+		}
 
+		// query user info by appid and other conditions
+		srv.query(w, r)
 		return
 	}
 
-	msg, err := srv.getMessage(r, "event", "subscribe", "unsubscribe", "LOCATION")
+	msg, err := srv.getMessage(r, "event", "subscribe", "unsubscribe", "LOCATION", "SCAN")
 	if err != nil {
 		log.Println(err.Error())
 		return
@@ -42,13 +68,16 @@ func (srv *WechatUserServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	r.ParseForm()
 
 	if msg.Event == "subscribe" {
-		go srv.subscribe(r, msg)
+		wx.Go(func() { srv.subscribe(r, msg) })
 	}
 	if msg.Event == "unsubscribe" {
-		go srv.unsubscribe(r, msg)
+		wx.Go(func() { srv.unsubscribe(r, msg) })
 	}
 	if msg.Event == "LOCATION" {
-		go srv.location(r, msg)
+		wx.Go(func() { srv.location(r, msg) })
+	}
+	if msg.Event == "SCAN" {
+		wx.Go(func() { srv.scan(r, msg) })
 	}
 }
 
@@ -94,6 +123,12 @@ func (srv *WechatUserServer) subscribe(r *http.Request, m *wx.WxMessage) {
 	}
 
 	key := strings.TrimPrefix(m.EventKey, "qrscene_")
+	event := "subscribe"
+	if old, err := NewStorage().LoadUser(appid, openid); err == nil && old.OpenId != "" {
+		event = "resubscribe"
+	}
+	srv.saveEvent(appid, openid, event, key, m.CreateTime)
+
 	u := &WxUser{
 		AppId:           appid,
 		OpenId:          openid,
@@ -112,15 +147,17 @@ func (srv *WechatUserServer) subscribe(r *http.Request, m *wx.WxMessage) {
 		HeadImgUrl: info.HeadImgUrl,
 		Remark:     info.Remark,
 	}
+	u.setTags(info.TagIdList)
 
 	err = NewStorage().SaveUser(u)
 	if err != nil {
 		log.Println(err.Error())
 		return
 	}
+	notifyWebhooks(event, u)
 }
 
-func (*WechatUserServer) unsubscribe(r *http.Request, m *wx.WxMessage) {
+func (srv *WechatUserServer) unsubscribe(r *http.Request, m *wx.WxMessage) {
 	log.Printf("unsubscribe: %#v\n", m)
 
 	f := r.Form
@@ -135,12 +172,14 @@ func (*WechatUserServer) unsubscribe(r *http.Request, m *wx.WxMessage) {
 
 	u.Subscribe = false
 	u.UnSubscribeTime = m.CreateTime
+	srv.saveEvent(appid, openid, "unsubscribe", u.Referral, m.CreateTime)
 
 	err = NewStorage().SaveUser(u)
 	if err != nil {
 		log.Println(err.Error())
 		return
 	}
+	notifyWebhooks("unsubscribe", u)
 }
 
 func (*WechatUserServer) location(r *http.Request, m *wx.WxMessage) {
@@ -150,16 +189,57 @@ func (*WechatUserServer) location(r *http.Request, m *wx.WxMessage) {
 	appid := f.Get("appid")
 
 	openid := m.FromUserName
+	err := NewStorage().SaveLocation(&WxLocation{
+		AppId:      appid,
+		OpenId:     openid,
+		Latitude:   m.Latitude,
+		Longitude:  m.Longitude,
+		Precision:  m.Precision,
+		CreateTime: m.CreateTime,
+	})
+	if err != nil {
+		log.Println(err.Error())
+	}
+
 	u, err := NewStorage().LoadUser(appid, openid)
 	if err != nil {
 		log.Println(err.Error())
 		return
 	}
+	if u.LocationTime > m.CreateTime {
+		return
+	}
 
 	u.Latitude = m.Latitude
 	u.Longitude = m.Longitude
 	u.Precision = m.Precision
 	u.LocationTime = m.CreateTime
+
+	err = NewStorage().SaveUser(u)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+}
+
+func (srv *WechatUserServer) scan(r *http.Request, m *wx.WxMessage) {
+	log.Printf("scan: %#v\n", m)
+
+	appid := r.Form.Get("appid")
+	srv.saveEvent(appid, m.FromUserName, "scan", m.EventKey, m.CreateTime)
+}
+
+func (*WechatUserServer) saveEvent(appid, openid, event, scene string, createTime uint64) {
+	err := NewStorage().SaveUserEvent(&WxUserEvent{
+		AppId:      appid,
+		OpenId:     openid,
+		Event:      event,
+		Scene:      scene,
+		CreateTime: createTime,
+	})
+	if err != nil {
+		log.Println(err.Error())
+	}
 }
 
 func (srv *WechatUserServer) getUserInfo(r *http.Request, appid, secret, openid string) (u *wxUserInfo, err error) {
@@ -169,7 +249,7 @@ func (srv *WechatUserServer) getUserInfo(r *http.Request, appid, secret, openid
 		return
 	}
 
-	url_base := "https://api.weixin.qq.com/cgi-bin/user/info"
+	url_base := wx.ApiBaseUrl + "/cgi-bin/user/info"
 	_url := fmt.Sprintf("%s?access_token=%s&openid=%s&lang=zh_CN", url_base, access_token, openid)
 	u = &wxUserInfo{}
 	_, err = wx.HttpGetJson(_url, u)
@@ -180,6 +260,24 @@ func (srv *WechatUserServer) getUserInfo(r *http.Request, appid, secret, openid
 	return
 }
 
+// update user profile from wechat user info
+func (u *WxUser) setProfile(info *wxUserInfo) {
+	u.UnionId = info.Unionid
+	u.Subscribe = info.Subscribe == 1
+	if info.SubscribeTime > 0 {
+		u.SubscribeTime = info.SubscribeTime
+	}
+	u.Nickname = info.Nickname
+	u.Sex = info.Sex
+	u.City = info.City
+	u.Country = info.Country
+	u.Province = info.Province
+	u.Language = info.Language
+	u.HeadImgUrl = info.HeadImgUrl
+	u.Remark = info.Remark
+	u.setTags(info.TagIdList)
+}
+
 type wxUserInfo struct {
 	wx.WxError
 	Openid        string `json:"openid"`         // 用户的标识，对当前公众号唯一
@@ -0,0 +1,260 @@
+package wrap
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"syscall"
+	"time"
+	wx "wechat-proxy/wechat"
+)
+
+const webhookRetry = 3
+
+// timeout of each webhook request
+var WebhookTimeout = 10 * time.Second
+
+var errWebhookAddress = errors.New("webhook url must be a public http or https address")
+
+// addresses webhooks may reach, replaced in tests
+var webhookIPAllowed = wx.IsPublicIP
+
+// client of webhooks, which must not reach internal networks, checked on every dial.
+// redirects are not followed.
+var webhookClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: func(network, address string, c syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if !webhookIPAllowed(net.ParseIP(host)) {
+					return errWebhookAddress
+				}
+				return nil
+			},
+		}).DialContext,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// user lifecycle events sent to webhooks
+var webhookEvents = map[string]bool{
+	"subscribe":   true,
+	"resubscribe": true,
+	"unsubscribe": true,
+	"profile":     true,
+}
+
+type WechatWebhookServer struct {
+}
+
+func NewWebhookServer() *WechatWebhookServer {
+	srv := &WechatWebhookServer{}
+	return srv
+}
+
+// /user/webhook?appid=...                                    (GET: list webhooks)
+// /user/webhook?appid=...&url=...&event=&event=&secret=      (POST: register webhook)
+// /user/webhook?appid=...&url=...                            (DELETE: remove webhook)
+// webhooks are only served under /app/<key>/user/webhook.
+func (srv *WechatWebhookServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	wx.Debugln(r.RequestURI)
+	app, ok := requireApp(w, r)
+	if !ok {
+		return
+	}
+	r.ParseForm()
+	f := r.Form
+	appid := app.AppId
+
+	switch r.Method {
+	case http.MethodPost:
+		h, err := srv.register(r, appid)
+		if err != nil {
+			w.Write(wx.JsonResponse(err))
+			return
+		}
+		w.Write(wx.JsonResponse(h))
+	case http.MethodDelete:
+		err := NewStorage().DeleteWebhook(appid, f.Get("url"))
+		w.Write(wx.JsonResponse(err))
+	default:
+		hooks, err := NewStorage().LoadWebhooks(appid)
+		if err != nil {
+			w.Write(wx.JsonResponse(err))
+			return
+		}
+		for _, h := range hooks {
+			h.Secret = "********"
+		}
+		w.Write(wx.JsonResponse(hooks))
+	}
+}
+
+// register or update webhook, secret is generated if not provided.
+func (srv *WechatWebhookServer) register(r *http.Request, appid string) (h *WxWebhook, err error) {
+	f := r.Form
+	u, err := url.Parse(f.Get("url"))
+	if err != nil {
+		return
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		err = errors.New("invalid webhook url")
+		return
+	}
+	err = checkWebhookHost(u.Hostname())
+	if err != nil {
+		return
+	}
+	for _, v := range f["event"] {
+		if !webhookEvents[v] {
+			err = fmt.Errorf("unknown event: %s", v)
+			return
+		}
+	}
+
+	h = &WxWebhook{
+		AppId:      appid,
+		Url:        u.String(),
+		Secret:     f.Get("secret"),
+		CreateTime: uint64(time.Now().Unix()),
+	}
+	h.setEvents(f["event"])
+	if h.Secret == "" {
+		h.Secret, err = randomKey()
+		if err != nil {
+			return
+		}
+	}
+	err = NewStorage().SaveWebhook(h)
+	return
+}
+
+// all addresses of host must be public, they are checked again when delivered.
+func checkWebhookHost(host string) (err error) {
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		ips, err = net.LookupIP(host)
+		if err != nil {
+			return
+		}
+	}
+	for _, ip := range ips {
+		if !webhookIPAllowed(ip) {
+			err = errWebhookAddress
+			return
+		}
+	}
+	return
+}
+
+// payload posted to webhooks
+type webhookPayload struct {
+	Event  string
+	AppId  string
+	OpenId string
+	Time   uint64
+	User   *WxUser
+}
+
+// post user event to all webhooks of the app in background.
+// header X-Wxproxy-Signature is hex of HMAC-SHA256(secret, timestamp + "\n" + body),
+// timestamp is unix seconds in header X-Wxproxy-Timestamp.
+func notifyWebhooks(event string, u *WxUser) {
+	hooks, err := NewStorage().LoadWebhooks(u.AppId)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+
+	p := &webhookPayload{
+		Event:  event,
+		AppId:  u.AppId,
+		OpenId: u.OpenId,
+		Time:   uint64(time.Now().Unix()),
+		User:   u,
+	}
+	body, err := json.Marshal(p)
+	if err != nil {
+		log.Println(err.Error())
+		return
+	}
+	for _, h := range hooks {
+		if h.hasEvent(event) {
+			h := h
+			wx.Go(func() { postWebhook(h, event, body) })
+		}
+	}
+}
+
+func postWebhook(h *WxWebhook, event string, body []byte) {
+	var err error
+	for i := 0; i < webhookRetry; i++ {
+		if i > 0 {
+			time.Sleep(time.Duration(i) * time.Second)
+		}
+		err = sendWebhook(h, event, body)
+		if err == nil {
+			return
+		}
+	}
+	log.Printf("webhook %s: %s\n", h.Url, err.Error())
+}
+
+func sendWebhook(h *WxWebhook, event string, body []byte) (err error) {
+	req, err := http.NewRequest(http.MethodPost, h.Url, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Wxproxy-Event", event)
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("X-Wxproxy-Timestamp", ts)
+	req.Header.Set("X-Wxproxy-Signature", webhookSign(h.Secret, ts, body))
+
+	ctx, cancel := context.WithTimeout(req.Context(), WebhookTimeout)
+	defer cancel()
+	resp, err := webhookClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	ioutil.ReadAll(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		err = fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return
+}
+
+func webhookSign(secret, ts string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "\n"))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func randomKey() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
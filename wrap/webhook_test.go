@@ -0,0 +1,112 @@
+package wrap
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+	wx "wechat-proxy/wechat"
+)
+
+func TestSendWebhook(t *testing.T) {
+	var got webhookPayload
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		sign := r.Header.Get("X-Wxproxy-Signature")
+		stamp := r.Header.Get("X-Wxproxy-Timestamp")
+		if !hmac.Equal([]byte(sign), []byte(webhookSign("key", stamp, body))) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		// receivers reject replays by timestamp
+		sec, _ := strconv.ParseInt(stamp, 10, 64)
+		if d := time.Since(time.Unix(sec, 0)); d > time.Minute || d < -time.Minute {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		json.Unmarshal(body, &got)
+	}))
+	defer ts.Close()
+
+	p := &webhookPayload{Event: "subscribe", AppId: "wx1", OpenId: "o1", User: &WxUser{AppId: "wx1", OpenId: "o1", Nickname: "alice"}}
+	body, _ := json.Marshal(p)
+
+	// test server is on loopback, which is not reached by default
+	err := sendWebhook(&WxWebhook{Url: ts.URL, Secret: "key"}, "subscribe", body)
+	if err == nil {
+		t.Fatal("loopback address reached")
+	}
+	webhookIPAllowed = func(net.IP) bool { return true }
+	defer func() { webhookIPAllowed = wx.IsPublicIP }()
+
+	err = sendWebhook(&WxWebhook{Url: ts.URL, Secret: "key"}, "subscribe", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Event != "subscribe" || got.User == nil || got.User.Nickname != "alice" {
+		t.Fatal(got)
+	}
+
+	err = sendWebhook(&WxWebhook{Url: ts.URL, Secret: "bad"}, "subscribe", body)
+	if err == nil {
+		t.Fatal("bad signature accepted")
+	}
+}
+
+func TestWebhookEvents(t *testing.T) {
+	h := &WxWebhook{}
+	if !h.hasEvent("profile") {
+		t.Fatal("empty events should match all")
+	}
+	h.setEvents([]string{"subscribe", "unsubscribe"})
+	if !h.hasEvent("unsubscribe") || h.hasEvent("profile") {
+		t.Fatal(h.Events)
+	}
+}
+
+func TestWebhookServer(t *testing.T) {
+	srv := NewWebhookServer()
+	app := &WxApp{Key: "hook", AppId: "wx-hook"}
+	defer NewStorage().DeleteWebhook("wx-hook", "https://203.0.113.10/hook")
+
+	// not served without app
+	for _, method := range []string{"GET", "POST", "DELETE"} {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest(method, "/user/webhook?appid=wx-hook&url=https://203.0.113.10/hook", nil))
+		if w.Code != http.StatusForbidden {
+			t.Fatal(method, w.Code, w.Body.String())
+		}
+	}
+
+	// internal addresses are rejected
+	for _, u := range []string{"http://127.0.0.1/hook", "http://10.0.0.1/hook", "http://[::1]/hook", "http://localhost/hook", "ftp://203.0.113.10/hook"} {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, withApp(httptest.NewRequest("POST", "/user/webhook?url="+url.QueryEscape(u), nil), app))
+		if hooks, _ := NewStorage().LoadWebhooks("wx-hook"); len(hooks) != 0 {
+			t.Fatal(u, w.Body.String())
+		}
+	}
+
+	// appid of the query is ignored
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, withApp(httptest.NewRequest("POST", "/user/webhook?appid=wx-other&url=https://203.0.113.10/hook", nil), app))
+	hooks, err := NewStorage().LoadWebhooks("wx-hook")
+	if err != nil || len(hooks) != 1 {
+		t.Fatal(w.Body.String(), hooks, err)
+	}
+	if hooks, _ := NewStorage().LoadWebhooks("wx-other"); len(hooks) != 0 {
+		t.Fatal(hooks)
+	}
+
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, withApp(httptest.NewRequest("DELETE", "/user/webhook?url=https://203.0.113.10/hook", nil), app))
+	if hooks, _ := NewStorage().LoadWebhooks("wx-hook"); len(hooks) != 0 {
+		t.Fatal(w.Body.String(), hooks)
+	}
+}
@@ -1,19 +1,64 @@
 package main
 
 import (
-	"flag"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 	"wechat-proxy/enterprise"
 	"wechat-proxy/wechat"
 	"wechat-proxy/wrap"
 )
 
 func main() {
-	wrapHandlers()
-	wechatHandlers()
+	c, rekey, err := loadConfig(os.Args)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = c.apply()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = wrap.InitStorage(c.Db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer wrap.NewStorage().Close()
+
+	// encrypt plaintext secrets, and rewrap them after master key rotation
+	n, err := wrap.NewStorage().RekeyApps()
+	if rekey {
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%d apps rekeyed.\n", n)
+		return
+	}
+	if err == wrap.ErrNoMasterKey {
+		log.Println("master key is not set, secrets are stored in plaintext.")
+	} else if err != nil {
+		log.Fatal(err)
+	}
+
+	// apps registered by config file
+	err = wrap.RegisterApps(c.Apps)
+	if err != nil {
+		log.Fatal(err)
+	}
+	warnUnsignedApps()
+
+	// observe requests to wechat api
+	http.DefaultClient.Transport = wechat.NewMetricsTransport(http.DefaultTransport)
+
+	apiServer, msgServer, payServer := wechatHandlers()
+	adminHandlers(apiServer, msgServer, payServer, c.Admin)
+	workers := wrapHandlers(msgServer, c.Admin, c.OpenRegister)
 	enterpriseHandlers()
 
 	http.Handle("/example/", http.StripPrefix("/example/", http.FileServer(http.Dir("./example"))))
@@ -28,72 +73,248 @@ func main() {
 		log.Println(string(body))
 	})
 
-	host, port, tls := parseArgs()
-	address := fmt.Sprintf("%s:%d", host, port)
-	fmt.Printf("wechat proxy starting at %q ...\n", address)
+	fmt.Printf("wechat proxy starting at %q ...\n", c.Listen)
 
-	if tls {
-		log.Fatal(http.ListenAndServeTLS(address, "wxproxy.crt", "wxproxy.key", nil))
+	server := &http.Server{Addr: c.Listen}
+	servers := []*http.Server{server}
+	if c.Tls.Enable {
+		var challenge *http.Server
+		server.TLSConfig, challenge, err = c.tlsConfig()
+		if err != nil {
+			log.Fatal(err)
+		}
+		if challenge != nil {
+			servers = append(servers, challenge)
+		}
+	}
+	done := make(chan bool)
+	go shutdown(servers, workers, c.shutdownTimeout, done)
+
+	if c.Tls.Enable {
+		err = server.ListenAndServeTLS("", "")
 	} else {
-		log.Fatal(http.ListenAndServe(address, nil))
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
 	}
+
+	// storage is closed by defer after draining
+	<-done
 }
 
-func parseArgs() (host string, port uint, tls bool) {
+// apps accepting requests without signature, and apps without client secret only served to allowed ips
+func warnUnsignedApps() {
+	apps, err := wrap.NewStorage().LoadApps()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, app := range apps {
+		if app.Unsigned {
+			log.Printf("WARNING: app %s is unsigned, requests are not verified.\n", app.Key)
+		} else if app.ClientSecret == "" && app.AllowIps == "" {
+			log.Printf("app %s has no client secret or allowed ips, requests are rejected, reset its secret or set unsigned.\n", app.Key)
+		}
+	}
+}
 
-	flag.UintVar(&port, "port", 8080, "Listening port.")
-	flag.UintVar(&port, "p", 8080, "Listening port.")
-	flag.BoolVar(&tls, "tls", false, "Https scheme.")
+// background workers of wrap servers (broadcast queue, follower sync)
+type worker interface {
+	Close(timeout time.Duration) bool
+}
 
-	flag.Parse()
-	return
+// on SIGINT or SIGTERM, drain workers while the proxy still serves access tokens to them,
+// then stop accepting connections, wait for in-flight requests
+// and background tasks (event handlers, webhooks) until timeout.
+func shutdown(servers []*http.Server, workers []worker, timeout time.Duration, done chan bool) {
+	defer close(done)
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+	log.Println("shutting down ...")
+
+	deadline := time.Now().Add(timeout)
+	for _, w := range workers {
+		if !w.Close(time.Until(deadline)) {
+			log.Println("background workers are not finished in time.")
+		}
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	for _, server := range servers {
+		err := server.Shutdown(ctx)
+		if err != nil {
+			log.Println(err.Error())
+		}
+	}
+	if !wechat.Wait(time.Until(deadline)) {
+		log.Println("background tasks are not finished in time.")
+	}
 }
 
-func wrapHandlers() {
+func wrapHandlers(msgServer *wechat.WechatMessageServer, admin string, openRegister bool) (workers []worker) {
 
 	// /register?key=...&appid=...&secret=...
 	// &token=&aes=
 	// &mch_id=&mch_key=&server_ip=
-	// &expires=&call=/msg&call=/api&call=
-	http.Handle("/register", wrap.NewRegisterServer())
+	// &expires=&call=/msg&call=/api&call=&owner=
+	// /register/tenant?name=...
+	// header: Authorization: Bearer <admin token or api key>
+	registerServer := wrap.NewRegisterServer()
+	registerServer.AdminToken = admin
+	registerServer.Open = openRegister
+	if admin == "" && openRegister {
+		log.Println("WARNING: admin token is not set and -open-register is on, anyone with valid appid and secret can register apps.")
+	} else if admin == "" {
+		log.Println("admin token is not set, /register only accepts api keys of existing tenants, set -admin to register apps.")
+	}
+	http.Handle("/register", registerServer)
+	http.Handle("/register/tenant", registerServer)
 
 	// /app/<key>/api
 	// /app/<key>/msg?signature=...
 	// ...
 	http.Handle("/app/", wrap.NewWrapAppServer())
 
+	// events of /app/<key>/msg are handled, relative calls are served in process
+	msgServer.Trusted = wrap.IsAppRequest
+	msgServer.Handler = http.DefaultServeMux
+
 	// /qrcode?path=...&size=
 	http.Handle("/qrcode", wrap.NewQrCodeServer())
 
+	// served under /app/<key>/ only
+	// /qrcode/scene?appid=...&secret=...&scene=...&channel=&permanent=&expires=&format=
+	// /qrcode/scenes?appid=...
+	sceneServer := wrap.NewSceneServer()
+	http.Handle("/qrcode/scene", sceneServer)
+	http.Handle("/qrcode/scenes", sceneServer)
+
 	// /short?path=...&expires=
 	// http.Handle("/short/", wrap.NewShortServer())
 
+	// served under /app/<key>/ only, appid is filled by the registered app
 	// /user
+	// /user/report?appid=...&begin=&end=
+	// /user/track?appid=...&openid=...&begin=&end=
+	// /user/near?appid=...&lat=...&lng=...&radius=&since=
+	// /user/identity?appid=...&openid=&unionid=
+	// /user/resolve?appid=...&openid=...&to=...
 	userServer := wrap.NewUserServer()
 	http.Handle("/user", userServer)
+	http.Handle("/user/", userServer)
+
+	// served under /app/<key>/ only
+	// /user/sync?appid=...&secret=...&interval=
+	syncServer := wrap.NewSyncServer()
+	http.Handle("/user/sync", syncServer)
+	workers = append(workers, syncServer)
+
+	// served under /app/<key>/ only
+	// /user/webhook?appid=...&url=&event=&secret=
+	http.Handle("/user/webhook", wrap.NewWebhookServer())
+
+	// served under /app/<key>/ only
+	// /tags?appid=...&secret=...
+	// /tags/create?appid=...&secret=...&name=...
+	// /tags/update?appid=...&secret=...&id=...&name=...
+	// /tags/delete?appid=...&secret=...&id=...
+	// /tags/tagging?appid=...&secret=...&id=...&openid=...
+	// /tags/untagging?appid=...&secret=...&id=...&openid=...
+	tagServer := wrap.NewTagServer()
+	http.Handle("/tags", tagServer)
+	http.Handle("/tags/", tagServer)
+
+	// served under /app/<key>/ only
+	// /template/send?appid=...&secret=...&openid=&template=
+	// /template/alias?appid=...&alias=
+	// /template/status?appid=...&msgid=...
+	templateServer := wrap.NewTemplateServer()
+	http.Handle("/template/", templateServer)
+	msgServer.HandleEvent("TEMPLATESENDJOBFINISH", templateServer.JobFinish)
+
+	// served under /app/<key>/ only
+	// /broadcast?appid=...&secret=...
+	// /broadcast/status?appid=...&id=...
+	broadcastServer := wrap.NewBroadcastServer()
+	http.Handle("/broadcast", broadcastServer)
+	http.Handle("/broadcast/status", broadcastServer)
+	msgServer.HandleEvent("MASSSENDJOBFINISH", broadcastServer.JobFinish)
+	workers = append(workers, broadcastServer)
+
+	// served under /app/<key>/ only
+	// /menu?appid=...&secret=...
+	// /menu/delete?appid=...&secret=...&menuid=
+	// /menu/versions?appid=...&version=
+	// /menu/diff?appid=...&from=&to=
+	// /menu/rollback?appid=...&secret=...&version=...
+	menuServer := wrap.NewMenuServer()
+	http.Handle("/menu", menuServer)
+	http.Handle("/menu/", menuServer)
+	return
 }
 
-func wechatHandlers() {
+func adminHandlers(apiServer *wechat.WechatApiServer, msgServer *wechat.WechatMessageServer,
+	payServer *wechat.WechatPayServer, admin string) {
+
+	// /admin/apps?offset=&limit=&owner=
+	// /admin/apps/<key>
+	// /admin/apps/<key>/renew
+	// /admin/apps/<key>/usage
+	// /admin/tokens
+	// /admin/messages?appid=
+	// /admin/orders?appid=
+	// /admin/users?appid=...
+	// header: Authorization: Bearer <admin token>
+	adminServer := wrap.NewAdminServer()
+	adminServer.AdminToken = admin
+	adminServer.ApiServer = apiServer
+	adminServer.MsgServer = msgServer
+	adminServer.PayServer = payServer
+	http.Handle("/admin/apps", adminServer)
+	http.Handle("/admin/apps/", adminServer)
+	http.Handle("/admin/tokens", adminServer)
+	http.Handle("/admin/messages", adminServer)
+	http.Handle("/admin/orders", adminServer)
+	http.Handle("/admin/users", adminServer)
+
+	// admin console
+	http.Handle("/admin/", http.StripPrefix("/admin/", wrap.NewConsoleServer()))
+
+	// prometheus metrics
+	// header: Authorization: Bearer <admin token>, if admin token is set
+	metricsServer := wrap.NewMetricsServer()
+	metricsServer.AdminToken = admin
+	if admin == "" {
+		log.Println("admin token is not set, /metrics is public.")
+	}
+	http.Handle("/metrics", metricsServer)
+}
+
+func wechatHandlers() (apiServer *wechat.WechatApiServer, msgServer *wechat.WechatMessageServer,
+	payServer *wechat.WechatPayServer) {
 
 	// /api?appid=...&secret=...
 	// /api/new?appid=...&secret=...
-	apiServer := wechat.NewApiServer()
+	apiServer = wechat.NewApiServer()
 	http.Handle("/api", apiServer)
 	http.Handle("/api/new", apiServer)
 
 	// /msg?token=...&aes=...&call=...&call=...&...
 	// /msg/json?token=...&aes=...&call=...&call=...&...
-	msgServer := wechat.NewMessageServer()
+	msgServer = wechat.NewMessageServer()
 	http.Handle("/msg", msgServer)
 	http.Handle("/msg/json", msgServer)
 
 	// /auth??appid=...&secret=...&call=...&state=&lang=
 	// /auth/info?appid=...&secret=...&call=...&state=&lang=
 	authServer := wechat.NewAuthServer()
+	authServer.LinkOpenIds = wrap.LinkOpenIds
 	http.Handle("/auth", authServer)      // get openid & unionid
 	http.Handle("/auth/info", authServer) // get user info
 
-	payServer := wechat.NewPayServer()
+	payServer = wechat.NewPayServer()
 	http.Handle("/pay", payServer)
 	// /pay/qrcode?
 	// &appid=...&mch_id=...&mch_key=...&server_ip=...
@@ -112,6 +333,15 @@ func wechatHandlers() {
 	http.Handle("/js/config", wechat.NewJsConfigServer())
 
 	http.Handle("/js/card", wechat.NewCardServer())
+
+	// /media/upload?appid=...&secret=...&type=...&url=
+	// /material/add?appid=...&secret=...&type=...&url=
+	// /material/uploadimg?appid=...&secret=...&url=
+	mediaServer := wechat.NewMediaServer()
+	http.Handle("/media/upload", mediaServer)
+	http.Handle("/material/add", mediaServer)
+	http.Handle("/material/uploadimg", mediaServer)
+	return
 }
 
 func enterpriseHandlers() {